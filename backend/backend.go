@@ -9,6 +9,12 @@ type Backend interface {
 	Proc(req *protocol.Msg) (*protocol.Msg, error)
 	GetNodeIndexByKey([]byte) uint32
 	ForwardMsg(uint32, *protocol.Msg) (*protocol.Msg, error)
+	// 同一节点的多个请求 pipeline 转发, 响应与请求一一对应
+	ForwardMultiMsg(uint32, []*protocol.Msg) ([]*protocol.Msg, error)
+	// 批量处理客户端 pipeline 的请求, 响应按请求顺序返回, 处理失败的请求对应的响应为 nil
+	ProcPipeline([]*protocol.Msg) ([]*protocol.Msg, error)
 	GetNodes() []*nodes.Node
 	GetConf() interface{}
+	// 关闭所有节点的连接, 关闭后不能再使用
+	Close()
 }
@@ -100,6 +100,9 @@ func newCluster(name string, nodeList []*nodes.Node, slotsNum uint16) (c *Cluste
 	// 定时刷新
 	go func() {
 		for range time.Tick(defaultRefreshInterval) {
+			if c.IsClosed() {
+				return
+			}
 			if err := c.refresh(); err != nil {
 				log.Infof("刷新cluster slots出错。Info: %s", err.Error())
 			}
@@ -242,7 +245,7 @@ func (c *Cluster) GetNodeByMasterAddr(addr string) (node *nodes.Node, err error)
 
 func (c *Cluster) GetNodeByKey(key []byte) (node *nodes.Node, err error) {
 	slot := c.hash(key, c.mask)
-	node, ok := c.slots.slots[slot]
+	node, ok := c.slots.getSlot(slot)
 	if !ok {
 		return nil, fmt.Errorf("槽位 %d 未分配", slot)
 	}
@@ -260,3 +263,22 @@ func (c *Cluster) GetNodes() []*nodes.Node {
 func (c *Cluster) GetConf() interface{} {
 	return c.conf
 }
+
+func (c *Cluster) Close() {
+	c.Lock()
+	if c.isClosed {
+		c.Unlock()
+		return
+	}
+	c.isClosed = true
+	c.Unlock()
+	for _, node := range c.nodes {
+		node.Close()
+	}
+}
+
+func (c *Cluster) IsClosed() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.isClosed
+}
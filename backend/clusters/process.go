@@ -3,6 +3,7 @@ package cluster
 import (
 	"bytes"
 	"fmt"
+	"ncache/backend/command"
 	"ncache/backend/nodes"
 	"ncache/protocol"
 )
@@ -20,6 +21,62 @@ func (c *Cluster) ForwardMsg(index uint32, msg *protocol.Msg) (msgAck *protocol.
 	return c.forwardMsg(node, msg, false, 0)
 }
 
+func (c *Cluster) ForwardMultiMsg(index uint32, msgList []*protocol.Msg) (msgAckList []*protocol.Msg, err error) {
+	var (
+		node *nodes.Node
+		ok   bool
+	)
+	if node, ok = c.slots.getSlot(uint16(index)); !ok {
+		return nil, fmt.Errorf("slot %d not specified", index)
+	}
+	return c.forwardMultiMsg(node, msgList)
+}
+
+func (c *Cluster) ProcPipeline(msgList []*protocol.Msg) (msgAckList []*protocol.Msg, err error) {
+	return command.PipelineProc(c, msgList, c.forwardByNode)
+}
+
+// 不同槽位可能属于同一节点, 按节点分组可以减少 pipeline 的次数
+func (c *Cluster) forwardByNode(msgList []*protocol.Msg) ([]*protocol.Msg, error) {
+	var (
+		nodeList []*nodes.Node
+		groups   [][]int
+		groupMap = make(map[*nodes.Node]int)
+	)
+	for i, msg := range msgList {
+		key, _ := msg.GetArray()[1].GetValueBytes()
+		node, err := c.GetNodeByKey(key)
+		if err != nil {
+			return nil, err
+		}
+		pos, ok := groupMap[node]
+		if !ok {
+			pos = len(groups)
+			groupMap[node] = pos
+			nodeList = append(nodeList, node)
+			groups = append(groups, nil)
+		}
+		groups[pos] = append(groups[pos], i)
+	}
+	return command.ForwardGroups(msgList, groups, func(pos int, group []*protocol.Msg) ([]*protocol.Msg, error) {
+		return c.forwardMultiMsg(nodeList[pos], group)
+	})
+}
+
+// 批量转发后, 对需要重定向的请求单独重新转发
+func (c *Cluster) forwardMultiMsg(node *nodes.Node, msgList []*protocol.Msg) (msgAckList []*protocol.Msg, err error) {
+	db := node.GetMultiDb(msgList)
+	if msgAckList, err = forwardMultiMsgToDb(msgList, db); err != nil {
+		return nil, err
+	}
+	for i, msgAck := range msgAckList {
+		if msgAckList[i], err = c.handleRedirect(msgList[i], msgAck, 0); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
 func (c *Cluster) forwardMsg(node *nodes.Node, msg *protocol.Msg, isAsking bool, redirectTime int) (msgAck *protocol.Msg, err error) {
 	if redirectTime > c.redirectTime {
 		return nil, fmt.Errorf("Exceed max redirect time: %d", c.redirectTime)
@@ -29,50 +86,46 @@ func (c *Cluster) forwardMsg(node *nodes.Node, msg *protocol.Msg, isAsking bool,
 	if err != nil {
 		return nil, err
 	}
-	if msgAck.IsError() {
-		bytesValue, _ := msgAck.GetValueBytes()
-		var msgAckBytesValueSplit [][]byte = bytes.Fields(bytesValue)
-		if len(msgAckBytesValueSplit) != 3 {
-			return
-		}
-		switch {
-		case bytes.EqualFold(msgAckBytesValueSplit[0], []byte("MOVED")):
-			addr := string(msgAckBytesValueSplit[2])
-			movedNode, err := c.GetNodeByMasterAddr(addr)
-			if err != nil {
-				return nil, err
-			}
-			return c.forwardMsg(movedNode, msg, false, redirectTime+1)
-		case bytes.EqualFold(msgAckBytesValueSplit[0], []byte("ASK")):
-			addr := string(msgAckBytesValueSplit[2])
-			movedNode, err := c.GetNodeByMasterAddr(addr)
-			if err != nil {
-				return nil, err
-			}
-			return c.forwardMsg(movedNode, msg, true, redirectTime+1)
-		}
-	}
-	return
+	return c.handleRedirect(msg, msgAck, redirectTime)
 }
 
-func forwardMsgToDb(msg *protocol.Msg, db *nodes.Db, isAsking bool) (ack *protocol.Msg, err error) {
-	conn, err := db.GetConnect()
-	if err != nil {
-		return nil, err
+// 处理 MOVED/ASK 重定向, 其他响应原样返回
+func (c *Cluster) handleRedirect(msg, msgAck *protocol.Msg, redirectTime int) (*protocol.Msg, error) {
+	if !msgAck.IsError() {
+		return msgAck, nil
+	}
+	bytesValue, _ := msgAck.GetValueBytes()
+	var msgAckBytesValueSplit [][]byte = bytes.Fields(bytesValue)
+	if len(msgAckBytesValueSplit) != 3 {
+		return msgAck, nil
 	}
-	defer db.PutConn(conn)
-	if !db.IsMaster() {
-		if err = conn.SendReadOnly(); err != nil {
+	switch {
+	case bytes.EqualFold(msgAckBytesValueSplit[0], []byte("MOVED")):
+		addr := string(msgAckBytesValueSplit[2])
+		movedNode, err := c.GetNodeByMasterAddr(addr)
+		if err != nil {
 			return nil, err
 		}
-	}
-	if isAsking {
-		if err = conn.SendAsking(); err != nil {
+		return c.forwardMsg(movedNode, msg, false, redirectTime+1)
+	case bytes.EqualFold(msgAckBytesValueSplit[0], []byte("ASK")):
+		addr := string(msgAckBytesValueSplit[2])
+		movedNode, err := c.GetNodeByMasterAddr(addr)
+		if err != nil {
 			return nil, err
 		}
+		return c.forwardMsg(movedNode, msg, true, redirectTime+1)
 	}
-	if ack, err = conn.HandleMsg(msg); err != nil {
-		return nil, err
+	return msgAck, nil
+}
+
+// 从节点的连接建立时已发送 READONLY
+func forwardMsgToDb(msg *protocol.Msg, db *nodes.Db, isAsking bool) (ack *protocol.Msg, err error) {
+	if isAsking {
+		return db.ProcAskingCmdMsg(msg)
 	}
-	return ack, nil
+	return db.ProcCmdMsg(msg)
+}
+
+func forwardMultiMsgToDb(msgList []*protocol.Msg, db *nodes.Db) (acks []*protocol.Msg, err error) {
+	return db.ProcMultiCmdMsg(msgList)
 }
@@ -0,0 +1,132 @@
+package command
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"ncache/backend"
+	"ncache/protocol"
+)
+
+// 转发一段不含多 key 命令的请求, 返回的响应与请求一一对应
+type ForwardFunc func(msgList []*protocol.Msg) ([]*protocol.Msg, error)
+
+// 需要拆分到多个节点执行的命令
+func IsMultiKeyMsg(msg *protocol.Msg) bool {
+	methodByte, _ := msg.GetArray()[0].GetValueBytes()
+	switch strings.ToUpper(string(methodByte)) {
+	case "MSET", "MGET", "DEL", "EXISTS":
+		return true
+	}
+	return false
+}
+
+// 以多 key 命令为界将请求分段, 每段内的请求由 fnForward 分组 pipeline 转发,
+// 多 key 命令仍由 be.Proc 处理, 保证同一节点上请求的执行顺序与客户端发送顺序一致.
+// fnForward 为 nil 时按节点下标分组.
+// 返回的响应与 msgList 一一对应, 处理失败的请求对应的响应为 nil, err 为第一个错误
+func PipelineProc(be backend.Backend, msgList []*protocol.Msg, fnForward ForwardFunc) (ackList []*protocol.Msg, err error) {
+	if fnForward == nil {
+		fnForward = func(msgList []*protocol.Msg) ([]*protocol.Msg, error) {
+			return ForwardByIndex(be, msgList)
+		}
+	}
+	ackList = make([]*protocol.Msg, len(msgList))
+	setErr := func(e error) {
+		if err == nil {
+			err = e
+		}
+	}
+	begin := 0
+	forwardSegment := func(end int) {
+		if begin < end {
+			acks, e := fnForward(msgList[begin:end])
+			copy(ackList[begin:end], acks)
+			if e != nil {
+				setErr(e)
+			}
+		}
+	}
+	for i, msg := range msgList {
+		if !IsMultiKeyMsg(msg) {
+			continue
+		}
+		forwardSegment(i)
+		begin = i + 1
+		ack, e := be.Proc(msg)
+		if e != nil {
+			setErr(e)
+		}
+		ackList[i] = ack
+	}
+	forwardSegment(len(msgList))
+	return
+}
+
+// 按 key 所在的节点下标分组, 每组通过 ForwardMultiMsg 转发
+func ForwardByIndex(be backend.Backend, msgList []*protocol.Msg) ([]*protocol.Msg, error) {
+	var (
+		indexList []uint32
+		groups    [][]int
+		groupMap  = make(map[uint32]int)
+	)
+	for i, msg := range msgList {
+		key, _ := msg.GetArray()[1].GetValueBytes()
+		index := be.GetNodeIndexByKey(key)
+		pos, ok := groupMap[index]
+		if !ok {
+			pos = len(groups)
+			groupMap[index] = pos
+			indexList = append(indexList, index)
+			groups = append(groups, nil)
+		}
+		groups[pos] = append(groups[pos], i)
+	}
+	return ForwardGroups(msgList, groups, func(pos int, group []*protocol.Msg) ([]*protocol.Msg, error) {
+		return be.ForwardMultiMsg(indexList[pos], group)
+	})
+}
+
+// groups 为 msgList 的下标分组, 各组并行执行, 组内请求保持原有顺序.
+// 失败分组中请求对应的响应为 nil, err 为第一个错误
+func ForwardGroups(msgList []*protocol.Msg, groups [][]int,
+	fn func(pos int, group []*protocol.Msg) ([]*protocol.Msg, error)) (ackList []*protocol.Msg, err error) {
+	ackList = make([]*protocol.Msg, len(msgList))
+	var mux sync.Mutex
+	forward := func(pos int) {
+		group := make([]*protocol.Msg, len(groups[pos]))
+		for i, index := range groups[pos] {
+			group[i] = msgList[index]
+		}
+		acks, e := fn(pos, group)
+		if e == nil && len(acks) != len(group) {
+			e = fmt.Errorf("pipeline expect %d replies, got %d", len(group), len(acks))
+		}
+		if e != nil {
+			mux.Lock()
+			if err == nil {
+				err = e
+			}
+			mux.Unlock()
+			return
+		}
+		for i, index := range groups[pos] {
+			ackList[index] = acks[i]
+		}
+	}
+	if len(groups) == 1 {
+		forward(0)
+		return
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(len(groups))
+	for pos := range groups {
+		go func(pos int) {
+			defer wg.Done()
+			forward(pos)
+		}(pos)
+	}
+	wg.Wait()
+	return
+}
@@ -2,13 +2,17 @@ package nodes
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"ncache/config"
 	"ncache/protocol"
 	"ncache/utils"
 	"io"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,6 +21,37 @@ var (
 	errDbClosed      = errors.New("db closed")
 )
 
+// 后端单次读写的最长超时, 单位纳秒, 0 为不限制
+var maxIoTimeout int64
+
+// 以代理的请求超时限制后端读写超时, 请求超时后仍在后台进行的后端处理最多再等待 d 即失败并释放连接
+func SetMaxIoTimeout(d time.Duration) {
+	atomic.StoreInt64(&maxIoTimeout, int64(d))
+}
+
+// 读写的截止时间, ms 为连接配置的超时
+func ioDeadline(ms int) time.Time {
+	d := time.Duration(ms) * time.Millisecond
+	if max := time.Duration(atomic.LoadInt64(&maxIoTimeout)); max > 0 && max < d {
+		d = max
+	}
+	return time.Now().Add(d)
+}
+
+// 后端认证失败, 与网络错误区分, 重试无法恢复
+type authError struct {
+	msg string
+}
+
+func (this *authError) Error() string {
+	return "auth failed: " + this.msg
+}
+
+func isAuthError(err error) bool {
+	_, ok := err.(*authError)
+	return ok
+}
+
 type PingFunc func(reader io.Reader, writer io.Writer) error
 
 const (
@@ -42,15 +77,22 @@ type Conn struct {
 	connTimeout  int
 	readTimeout  int
 	writeTimeout int
-	status       int
+	status       int32 // 复用连接时读写在不同协程, 需原子操作
 	pingFunc     PingFunc
 	br           *bufio.Reader
 	bw           *bufio.Writer
 	flag         int
+	user         string
+	pass         string
+	db           int
+	// 不为空时使用 TLS 连接
+	tlsConfig *tls.Config
+	// 集群从节点的连接, 建立后需发送 READONLY
+	readOnly bool
 	sync.RWMutex
 }
 
-func NewConn(addr string, pingFunc PingFunc, dbConf *config.DbConf) (conn *Conn, err error) {
+func NewConn(addr string, pingFunc PingFunc, dbConf *config.DbConf, tlsConfig *tls.Config) (conn *Conn, err error) {
 	conn = &Conn{
 		addr:         addr,
 		connTimeout:  dbConf.ConnTimeout,
@@ -59,6 +101,11 @@ func NewConn(addr string, pingFunc PingFunc, dbConf *config.DbConf) (conn *Conn,
 		pingFunc:     pingFunc,
 		flag:         defaultFlag,
 		status:       1,
+		user:         dbConf.User,
+		pass:         dbConf.Pass,
+		db:           dbConf.Db,
+		readOnly:     dbConf.ReadOnly,
+		tlsConfig:    tlsConfig,
 	}
 	if conn.connTimeout <= 0 {
 		conn.connTimeout = defaultConnTimeout
@@ -93,10 +140,31 @@ func (this *Conn) Connect() error {
 	tcpConn.SetReadBuffer(1024)
 	tcpConn.SetWriteBuffer(1024)
 	this.conn = tcpConn
-	this.status = connStatusConnected
+	if this.tlsConfig != nil {
+		tlsConn := tls.Client(tcpConn, this.tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(time.Duration(this.connTimeout) * time.Millisecond))
+		if err = tlsConn.Handshake(); err != nil {
+			tlsConn.Close()
+			return err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		this.conn = tlsConn
+	}
+	atomic.StoreInt32(&this.status, connStatusConnected)
 	this.br = bufio.NewReaderSize(this, defaultReadBufferSize)
 	this.bw = bufio.NewWriterSize(this, defaultWriteBufferSize)
 	this.updateActiveTime()
+	this.flag = defaultFlag
+	if err = this.auth(); err != nil {
+		this.Close()
+		return err
+	}
+	if this.readOnly {
+		if err = this.SendReadOnly(); err != nil {
+			this.Close()
+			return err
+		}
+	}
 	//fmt.Println("connected")
 	return nil
 }
@@ -105,27 +173,60 @@ func (this *Conn) HandleMsg(req *protocol.Msg) (rsp *protocol.Msg, err error) {
 	if this.IsClosed() {
 		return nil, errConnectClosed
 	}
-	if err = this.conn.SetWriteDeadline(time.Now().Add(time.Duration(this.writeTimeout) * time.Millisecond)); err != nil {
+	if err = this.conn.SetWriteDeadline(ioDeadline(this.writeTimeout)); err != nil {
 		return nil, err
 	}
 	if err = req.WriteMsg(this.bw); err != nil {
 		return nil, err
 	}
-	if err = this.conn.SetReadDeadline(time.Now().Add(time.Duration(this.readTimeout) * time.Millisecond)); err != nil {
+	if err = this.conn.SetReadDeadline(ioDeadline(this.readTimeout)); err != nil {
 		return nil, err
 	}
 	if rsp, err = protocol.NewMsgFromReader(this.br); err != nil {
+		this.closeIfBroken(err)
+		return nil, err
+	}
+	return
+}
+
+// pipeline 方式发送多个请求, 只 flush 一次, 再按顺序读取同样数量的响应
+func (this *Conn) HandleMultiMsg(reqs []*protocol.Msg) (rsps []*protocol.Msg, err error) {
+	if this.IsClosed() {
+		return nil, errConnectClosed
+	}
+	if err = this.conn.SetWriteDeadline(ioDeadline(this.writeTimeout)); err != nil {
+		return nil, err
+	}
+	if err = protocol.WriteMultiMsg(this.bw, reqs); err != nil {
 		return nil, err
 	}
+	if err = this.conn.SetReadDeadline(ioDeadline(this.readTimeout)); err != nil {
+		return nil, err
+	}
+	rsps = make([]*protocol.Msg, len(reqs))
+	for i := range reqs {
+		if rsps[i], err = protocol.NewMsgFromReader(this.br); err != nil {
+			// 未读完的响应会错位到后续请求上, 连接不能再复用
+			this.Close()
+			return nil, err
+		}
+	}
 	return
 }
 
+// 读取响应失败 (解析错误或超时) 后, 连接中残留或迟到的数据无法再对应后续请求, 需关闭连接
+func (this *Conn) closeIfBroken(err error) {
+	if err != nil {
+		this.Close()
+	}
+}
+
 func (this *Conn) Read(data []byte) (n int, err error) {
 	if this.IsClosed() {
 		return 0, errConnectClosed
 	}
 	if this.readTimeout > 0 {
-		if err = this.conn.SetReadDeadline(time.Now().Add(time.Duration(this.readTimeout) * time.Millisecond)); err != nil {
+		if err = this.conn.SetReadDeadline(ioDeadline(this.readTimeout)); err != nil {
 			this.Close()
 			return n, err
 		}
@@ -136,7 +237,7 @@ func (this *Conn) Read(data []byte) (n int, err error) {
 		if err == io.EOF {
 			this.Close()
 		} else {
-			this.status = connStatusSick
+			atomic.CompareAndSwapInt32(&this.status, connStatusConnected, connStatusSick)
 		}
 	}
 	return
@@ -147,7 +248,7 @@ func (this *Conn) Write(cmd []byte) (n int, err error) {
 		return 0, errConnectClosed
 	}
 	if this.writeTimeout > 0 {
-		if err = this.conn.SetWriteDeadline(time.Now().Add(time.Duration(this.readTimeout) * time.Millisecond)); err != nil {
+		if err = this.conn.SetWriteDeadline(ioDeadline(this.writeTimeout)); err != nil {
 			this.Close()
 			return n, err
 		}
@@ -155,14 +256,18 @@ func (this *Conn) Write(cmd []byte) (n int, err error) {
 	if n, err = this.conn.Write(cmd); err == nil {
 		this.updateActiveTime()
 	} else {
-		this.status = connStatusSick
+		atomic.CompareAndSwapInt32(&this.status, connStatusConnected, connStatusSick)
 		this.Close()
 	}
 	return
 }
 
 func (this *Conn) updateActiveTime() {
-	this.activeTime = utils.UnixTime()
+	atomic.StoreInt64(&this.activeTime, utils.UnixTime())
+}
+
+func (this *Conn) getActiveTime() int64 {
+	return atomic.LoadInt64(&this.activeTime)
 }
 
 func (this *Conn) Ping() (err error) {
@@ -176,9 +281,9 @@ func (this *Conn) Ping() (err error) {
 func (this *Conn) Close() error {
 	this.Lock()
 	defer this.Unlock()
-	if this.status != connStatusClosed {
+	if atomic.LoadInt32(&this.status) != connStatusClosed {
 		err := this.conn.Close()
-		this.status = connStatusClosed
+		atomic.StoreInt32(&this.status, connStatusClosed)
 		return err
 	}
 	//fmt.Println("con closed:", this.addr)
@@ -186,11 +291,40 @@ func (this *Conn) Close() error {
 }
 
 func (this *Conn) IsClosed() bool {
-	return this.status == connStatusClosed
+	return atomic.LoadInt32(&this.status) == connStatusClosed
 }
 
 func (this *Conn) IsSick() bool {
-	return this.status == connStatusSick
+	return atomic.LoadInt32(&this.status) == connStatusSick
+}
+
+// 连接加入连接池前认证并选择 db, 有用户名时使用 ACL 形式的 AUTH
+func (this *Conn) auth() error {
+	if this.pass != "" {
+		args := []string{"AUTH", this.pass}
+		if this.user != "" {
+			args = []string{"AUTH", this.user, this.pass}
+		}
+		rsp, err := this.HandleMsg(protocol.NewArrayMsgFormStrings(args))
+		if err != nil {
+			return err
+		}
+		if rsp.IsError() {
+			msg, _ := rsp.GetError()
+			return &authError{msg: msg}
+		}
+	}
+	if this.db != 0 {
+		rsp, err := this.HandleMsg(protocol.NewArrayMsgFormStrings([]string{"SELECT", strconv.Itoa(this.db)}))
+		if err != nil {
+			return err
+		}
+		if rsp.IsError() {
+			msg, _ := rsp.GetError()
+			return fmt.Errorf("select db %d: %s", this.db, msg)
+		}
+	}
+	return nil
 }
 
 func (this *Conn) SendReadOnly() (err error) {
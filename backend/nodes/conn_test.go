@@ -1,11 +1,14 @@
 package nodes
 
 import (
+	"bufio"
 	"fmt"
 	"ncache/config"
 	"ncache/protocol"
 	"ncache/utils"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestConn_Connect(t *testing.T) {
@@ -55,6 +58,25 @@ func TestConn_Write(t *testing.T) {
 
 }
 
+// 后端不响应时读写超时不超过 maxIoTimeout, 超时后关闭连接, 避免迟到的响应错位
+func TestConn_MaxIoTimeout(t *testing.T) {
+	defer SetMaxIoTimeout(0)
+	SetMaxIoTimeout(50 * time.Millisecond)
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		protocol.NewMsgFromReader(bufio.NewReader(server))
+	}()
+	conn := &Conn{conn: client, readTimeout: 3000, writeTimeout: 3000}
+	conn.br = bufio.NewReader(conn)
+	conn.bw = bufio.NewWriter(conn)
+	start := time.Now()
+	_, err := conn.HandleMsg(protocol.NewCmdMsg("GET a"))
+	utils.AssertMust(err != nil)
+	utils.AssertMust(time.Since(start) < time.Second)
+	utils.AssertMust(conn.IsClosed())
+}
+
 func newConn(addr string) (conn *Conn) {
 	dbConf := &config.DbConf{
 		Addr:         addr,
@@ -63,8 +85,53 @@ func newConn(addr string) (conn *Conn) {
 		WriteTimeout: 1000,
 	}
 	var err error
-	if conn, err = NewConn(addr, protocol.Ping, dbConf); err != nil {
+	if conn, err = NewConn(addr, protocol.Ping, dbConf, nil); err != nil {
 		utils.AssertMustNoError(err)
 	}
 	return
 }
+
+// 模拟需要认证的 redis, 密码为 secret
+func newAuthPipe(user, pass string, db int) *Conn {
+	client, server := net.Pipe()
+	conn := &Conn{
+		conn:         client,
+		readTimeout:  1000,
+		writeTimeout: 1000,
+		user:         user,
+		pass:         pass,
+		db:           db,
+	}
+	conn.br = bufio.NewReader(conn)
+	conn.bw = bufio.NewWriter(conn)
+	go func() {
+		defer server.Close()
+		br := bufio.NewReader(server)
+		for {
+			msg, err := protocol.NewMsgFromReader(br)
+			if err != nil {
+				return
+			}
+			args, _ := msg.Args()
+			reply := protocol.MsgOK
+			switch {
+			case args[0] == "AUTH" && args[len(args)-1] != "secret":
+				reply = protocol.NewErrorMsg("WRONGPASS invalid username-password pair")
+			case args[0] == "SELECT" && args[1] != "1":
+				reply = protocol.NewErrorMsg("ERR DB index is out of range")
+			}
+			if err = reply.WriteMsg(server); err != nil {
+				return
+			}
+		}
+	}()
+	return conn
+}
+
+func TestConn_Auth(t *testing.T) {
+	utils.AssertMustNoError(newAuthPipe("", "secret", 1).auth())
+	utils.AssertMustNoError(newAuthPipe("alice", "secret", 0).auth())
+	utils.AssertMust(isAuthError(newAuthPipe("", "wrong", 0).auth()))
+	err := newAuthPipe("", "secret", 2).auth()
+	utils.AssertMust(err != nil && !isAuthError(err))
+}
@@ -1,11 +1,14 @@
 package nodes
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"ncache/config"
 	"ncache/protocol"
+	"ncache/rule"
 	"ncache/utils"
+	"net"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,6 +18,8 @@ const (
 	DbStatusUP     = iota //正常工作
 	DbStatusDown          //停止工作
 	DbStatusReload        //重新载入
+	DbStatusClosed        //已关闭, 不再恢复
+	DbStatusNoAuth        //认证失败, 由健康检查重试
 
 	defaultInitConnNum = 10
 	defaultMaxConnNum  = 100
@@ -37,6 +42,7 @@ var (
 	errInitDb     = errors.New("init db failed")
 	errDbDown     = errors.New("db down")
 	errNoIdleConn = errors.New("no idle conn")
+	errAuthFailed = errors.New("db auth failed")
 )
 
 //redis 实例, 维护长连接
@@ -57,15 +63,40 @@ type Db struct {
 	chanRWMutex     sync.RWMutex
 	connCreateMutex sync.RWMutex
 	busy            int
+	// 后端使用 TLS 时的配置, 所有连接共用
+	tlsConfig *tls.Config
+	// 多路复用连接, muxConnNum > 0 时不再使用连接池
+	muxConns   []*muxConn
+	muxConnNum int
+	muxIndex   uint32
+	muxRWMutex sync.RWMutex
+	// 为 nil 时不熔断
+	breaker *rule.Breaker
 }
 
 func NewDb(conf *config.DbConf) (db *Db, err error) {
-	db = &Db{conf: conf, addr: conf.Addr, user: conf.User, pass: conf.Pass, initConnNum: conf.InitConnNum, maxConnNum: conf.MaxConnNum}
+	db = &Db{conf: conf, addr: conf.Addr, user: conf.User, pass: conf.Pass, initConnNum: conf.InitConnNum, maxConnNum: conf.MaxConnNum, muxConnNum: conf.MuxConnNum}
 	if conf.Role == "master" {
 		db.role = roleMaster
 	} else {
 		db.role = roleSlave
 	}
+	if conf.Tls != nil {
+		if db.tlsConfig, err = conf.Tls.ClientConfig(); err != nil {
+			return nil, err
+		}
+		if db.tlsConfig.ServerName == "" {
+			db.tlsConfig.ServerName, _, _ = net.SplitHostPort(conf.Addr)
+		}
+	}
+	// 同一节点可能配置在多个 backend 中, 统计项带上 backend 名称
+	breakerName := conf.Addr
+	if conf.Backend != "" {
+		breakerName = conf.Backend + "_" + conf.Addr
+	}
+	if db.breaker, err = rule.NewBreaker(breakerName, conf.Degrade); err != nil {
+		return nil, err
+	}
 	err = db.initDb()
 	tryTimes := 5
 	msWaitTime := 1000
@@ -79,16 +110,35 @@ func NewDb(conf *config.DbConf) (db *Db, err error) {
 
 func (this *Db) initDb() (err error) {
 	if _, err = this.createCheckConn(); err != nil {
+		if isAuthError(err) {
+			this.status = DbStatusNoAuth
+			fmt.Printf("[init db] addr:%s, %s\n", this.addr, err)
+		}
 		return errInitDb
 	}
+	if this.status != DbStatusUP {
+		// 重新初始化期间允许创建连接, 失败时恢复原状态
+		prevStatus := this.status
+		this.status = DbStatusReload
+		defer func() {
+			if err != nil {
+				this.status = prevStatus
+			}
+		}()
+	}
+	if this.muxConnNum > 0 {
+		return this.initMuxConns()
+	}
 	if this.initConnNum <= 0 {
 		this.initConnNum = defaultInitConnNum
 	}
 	if this.maxConnNum == 0 {
 		this.maxConnNum = utils.MaxInt(this.initConnNum, defaultMaxConnNum)
 	}
+	this.chanRWMutex.Lock()
 	this.initConnChan = make(chan *Conn, this.maxConnNum)
 	this.extraConnChan = make(chan *Conn, this.maxConnNum)
+	this.chanRWMutex.Unlock()
 	initConnFn := func() error {
 		_, err := this.createWorkConn(true)
 		return err
@@ -106,6 +156,10 @@ func (this *Db) initDb() (err error) {
 
 //todo: 简单实现
 func (this *Db) healthCheck(retryTime, msWaitTime int) (err error) {
+	if this.status == DbStatusClosed {
+		// 返回错误以结束定时任务
+		return errDbClosed
+	}
 	checkConn := this.getCheckConn()
 	if this.status == DbStatusUP {
 		if checkConn == nil {
@@ -116,19 +170,25 @@ func (this *Db) healthCheck(retryTime, msWaitTime int) (err error) {
 			return
 		}
 		if status := utils.RetryExecuteWithWait(func() error {
-			var err error
 			if checkConn, err = this.createCheckConn(); err == nil {
 				return checkConn.Ping()
 			} else {
 				return err
 			}
 		}, retryTime, msWaitTime); !status {
-			this.CloseDb()
+			if isAuthError(err) {
+				this.authFailed(err)
+			} else {
+				this.CloseDb()
+			}
 		}
 		fmt.Printf("[check db] addr:%s, db is up\n", this.addr)
 	} else if this.status == DbStatusDown {
 		this.initDb()
 		fmt.Printf("[check db] addr:%s, db is down\n", this.addr)
+	} else if this.status == DbStatusNoAuth {
+		this.initDb()
+		fmt.Printf("[check db] addr:%s, db auth failed\n", this.addr)
 	}
 	return nil
 }
@@ -149,14 +209,17 @@ func (this *Db) closeCheckConn() {
 }
 
 func (this *Db) newDbConn() (*Conn, error) {
-	return NewConn(this.addr, protocol.Ping, this.conf)
+	return NewConn(this.addr, protocol.Ping, this.conf, this.tlsConfig)
 }
 
 func (this *Db) idleConnCheck() error {
 	if this.status == DbStatusDown {
 		return errDbDown
 	}
-	if this.status == DbStatusReload {
+	if this.status == DbStatusClosed {
+		return errDbClosed
+	}
+	if this.status == DbStatusReload || this.status == DbStatusNoAuth || this.muxConnNum > 0 {
 		return nil
 	}
 	currentWorkConnNum := int(this.curWorkConnNum)
@@ -168,7 +231,7 @@ func (this *Db) idleConnCheck() error {
 			for i := 0; i < taskCloseIdleConnNum; i++ {
 				select {
 				case conn := <-extraConnChan:
-					if conn != nil && utils.UnixTime()-conn.activeTime > maxIdleTime {
+					if conn != nil && utils.UnixTime()-conn.getActiveTime() > maxIdleTime {
 						closeCount++
 						this.closeWorkConn(conn)
 					} else {
@@ -193,6 +256,12 @@ func (this *Db) createWorkConn(needPutChan bool) (*Conn, error) {
 	if this.status == DbStatusDown {
 		return nil, errDbDown
 	}
+	if this.status == DbStatusClosed {
+		return nil, errDbClosed
+	}
+	if this.status == DbStatusNoAuth {
+		return nil, errAuthFailed
+	}
 	this.connCreateMutex.Lock()
 	defer this.connCreateMutex.Unlock()
 	if int(this.curWorkConnNum) >= this.maxConnNum {
@@ -218,6 +287,12 @@ func (this *Db) GetConnect() (*Conn, error) {
 	if this.status == DbStatusDown {
 		return nil, errDbDown
 	}
+	if this.status == DbStatusClosed {
+		return nil, errDbClosed
+	}
+	if this.status == DbStatusNoAuth {
+		return nil, errAuthFailed
+	}
 	var (
 		firstChan  chan *Conn
 		secondChan chan *Conn
@@ -280,7 +355,7 @@ func (this *Db) popConn(chan1, chan2 <-chan *Conn, tryTimes int, msWaitTime int)
 			this.putConn(conn)
 			err = fmt.Errorf("%s, %s", descErrGetConnect, "conn is nil")
 		} else {
-			if utils.UnixTime()-conn.activeTime > pingInterval {
+			if utils.UnixTime()-conn.getActiveTime() > pingInterval {
 				if err = conn.Ping(); err != nil {
 					this.putConn(conn)
 					err = fmt.Errorf("%s, %s", descErrGetConnect, "ping err")
@@ -307,7 +382,7 @@ func (this *Db) popConnFromConnChan(connChan <-chan *Conn, tryTimes, msWaitTime
 				this.putConn(conn)
 				err = fmt.Errorf("%s, %s", descErrGetConnect, "conn is nil")
 			} else {
-				if utils.UnixTime()-conn.activeTime > pingInterval {
+				if utils.UnixTime()-conn.getActiveTime() > pingInterval {
 					if err = conn.Ping(); err != nil {
 						this.putConn(conn)
 						err = fmt.Errorf("%s, %s", descErrGetConnect, "ping err")
@@ -331,18 +406,37 @@ func (this *Db) putConn(conn *Conn) {
 	if this.status == DbStatusDown {
 		return
 	}
-	if conn == nil {
-		this.closeWorkConn(conn)
-	} else {
-		initConnChan := this.getInitConnChan()
-		if initConnChan != nil && len(initConnChan) < this.initConnNum {
-			initConnChan <- conn
-		} else {
-			extraConnChan := this.getExtraConnChan()
-			if extraConnChan != nil {
-				extraConnChan <- conn
-			}
+	if this.status == DbStatusClosed {
+		// 关闭后归还的连接直接关闭
+		if conn != nil {
+			conn.Close()
 		}
+		return
+	}
+	if conn == nil || conn.IsClosed() {
+		this.closeWorkConn(conn)
+	} else if !this.sendConn(conn) {
+		// 连接池已关闭, 直接关闭连接
+		conn.Close()
+	}
+}
+
+// 持有读锁放回连接池, closeConns 在写锁内置空 channel 后才关闭, 避免向已关闭的 channel 发送
+func (this *Db) sendConn(conn *Conn) bool {
+	this.chanRWMutex.RLock()
+	defer this.chanRWMutex.RUnlock()
+	c := this.initConnChan
+	if c == nil || len(c) >= this.initConnNum {
+		c = this.extraConnChan
+	}
+	if c == nil {
+		return false
+	}
+	select {
+	case c <- conn:
+		return true
+	default:
+		return false
 	}
 }
 
@@ -376,11 +470,28 @@ func (this *Db) closeWorkConn(conn *Conn) {
 	atomic.AddInt32(&this.curWorkConnNum, -1)
 }
 
-func (this *Db) ProcCmdMsg(msg *protocol.Msg) (replyMsg *protocol.Msg, err error) {
+// 熔断时不再获取连接, 按降级规则直接返回
+func (this *Db) ProcCmdMsg(msg *protocol.Msg) (*protocol.Msg, error) {
+	generation, ok := this.breaker.Allow()
+	if !ok {
+		return this.breaker.Degrade(msg)
+	}
+	start := time.Now()
+	replyMsg, err := this.procCmdMsg(msg)
+	this.breaker.Done(generation, err, time.Since(start))
+	return replyMsg, err
+}
+
+func (this *Db) procCmdMsg(msg *protocol.Msg) (replyMsg *protocol.Msg, err error) {
+	if this.muxConnNum > 0 {
+		return this.procMuxMsg(msg)
+	}
 	var conn *Conn
 	if conn, err = this.GetConnect(); err == nil {
 		if err = msg.WriteMsg(conn.bw); err == nil {
-			replyMsg, err = protocol.NewMsgFromReader(conn.br)
+			if replyMsg, err = protocol.NewMsgFromReader(conn.br); err != nil {
+				conn.closeIfBroken(err)
+			}
 		}
 		this.putConn(conn)
 	} else {
@@ -389,56 +500,176 @@ func (this *Db) ProcCmdMsg(msg *protocol.Msg) (replyMsg *protocol.Msg, err error
 	return
 }
 
-func (this *Db) ProcMultiCmdMsg(msgList []*protocol.Msg) (replyMsgList []*protocol.Msg, err error) {
-	msgLen := len(msgList)
-	replyMsgList = make([]*protocol.Msg, msgLen)
-	if msgLen == 0 {
-		return
+// 同一连接上 pipeline 执行, 响应与请求一一对应
+func (this *Db) ProcMultiCmdMsg(msgList []*protocol.Msg) ([]*protocol.Msg, error) {
+	if len(msgList) == 0 {
+		return nil, nil
 	}
-	var (
-		conn     *Conn
-		replyMsg *protocol.Msg
-	)
-	if conn, err = this.GetConnect(); err == nil {
-		for _, msg := range msgList {
-			if err = msg.WriteMsg(conn.bw); err == nil {
-				if replyMsg, err = protocol.NewMsgFromReader(conn.br); err == nil {
-					replyMsgList = append(replyMsgList, replyMsg)
-				} else {
-					replyMsgList = append(replyMsgList, nil)
-				}
-			}
+	generation, ok := this.breaker.Allow()
+	if !ok {
+		return this.breaker.DegradeMulti(msgList)
+	}
+	start := time.Now()
+	replyMsgList, err := this.procMultiCmdMsg(msgList)
+	this.breaker.Done(generation, err, time.Since(start))
+	return replyMsgList, err
+}
+
+func (this *Db) procMultiCmdMsg(msgList []*protocol.Msg) (replyMsgList []*protocol.Msg, err error) {
+	if this.muxConnNum > 0 {
+		var mc *muxConn
+		if mc, err = this.getMuxConn(); err != nil {
+			return nil, err
 		}
-		this.putConn(conn)
+		return mc.Do(msgList)
+	}
+	var conn *Conn
+	if conn, err = this.GetConnect(); err != nil {
+		return nil, err
 	}
+	replyMsgList, err = conn.HandleMultiMsg(msgList)
+	this.putConn(conn)
 	return
 }
 
-func (this *Db) CloseDb() {
+// 集群 ASK 重定向, ASKING 只对紧随其后的一条命令生效, 两者需在同一连接上连续发送
+func (this *Db) ProcAskingCmdMsg(msg *protocol.Msg) (replyMsg *protocol.Msg, err error) {
+	var replyMsgList []*protocol.Msg
+	if replyMsgList, err = this.ProcMultiCmdMsg([]*protocol.Msg{protocol.MsgAsking, msg}); err != nil {
+		return nil, err
+	}
+	return replyMsgList[1], nil
+}
+
+func (this *Db) initMuxConns() error {
+	muxConns := make([]*muxConn, this.muxConnNum)
+	num := 0
+	for i := range muxConns {
+		if conn, err := this.newDbConn(); err == nil {
+			muxConns[i] = newMuxConn(conn)
+			num++
+		}
+	}
+	if num == 0 {
+		return errInitDb
+	}
+	this.muxRWMutex.Lock()
+	this.muxConns = muxConns
+	this.muxRWMutex.Unlock()
+	this.status = DbStatusUP
+	fmt.Printf("[init db] addr:%s, db is up, mux conn num: %d\n", this.addr, num)
+	return nil
+}
+
+// 轮询选择复用连接, 连接已断开时重新建立
+func (this *Db) getMuxConn() (*muxConn, error) {
 	if this.status == DbStatusDown {
+		return nil, errDbDown
+	}
+	if this.status == DbStatusClosed {
+		return nil, errDbClosed
+	}
+	if this.status == DbStatusNoAuth {
+		return nil, errAuthFailed
+	}
+	index := int(atomic.AddUint32(&this.muxIndex, 1) % uint32(this.muxConnNum))
+	this.muxRWMutex.RLock()
+	mc := this.muxConns[index]
+	this.muxRWMutex.RUnlock()
+	if mc != nil && !mc.IsClosed() {
+		return mc, nil
+	}
+	this.muxRWMutex.Lock()
+	defer this.muxRWMutex.Unlock()
+	if mc = this.muxConns[index]; mc != nil && !mc.IsClosed() {
+		return mc, nil
+	}
+	conn, err := this.newDbConn()
+	if err != nil {
+		return nil, err
+	}
+	mc = newMuxConn(conn)
+	this.muxConns[index] = mc
+	return mc, nil
+}
+
+func (this *Db) procMuxMsg(msg *protocol.Msg) (*protocol.Msg, error) {
+	mc, err := this.getMuxConn()
+	if err != nil {
+		return nil, err
+	}
+	replyMsgList, err := mc.Do([]*protocol.Msg{msg})
+	if err != nil {
+		return nil, err
+	}
+	return replyMsgList[0], nil
+}
+
+func (this *Db) closeMuxConns() {
+	this.muxRWMutex.Lock()
+	defer this.muxRWMutex.Unlock()
+	for _, mc := range this.muxConns {
+		if mc != nil {
+			mc.Close()
+		}
+	}
+}
+
+func (this *Db) CloseDb() {
+	if this.status == DbStatusDown || this.status == DbStatusClosed {
 		return
 	}
 	this.status = DbStatusDown
-	initChan, extraChan := this.getInitConnChan(), this.getExtraConnChan()
+	this.closeConns()
+	fmt.Printf("[close db] addr:%s, db is down\n", this.addr)
+}
+
+// 认证失败时关闭所有连接, 密码修正后由健康检查重新初始化
+func (this *Db) authFailed(err error) {
+	if this.status == DbStatusClosed || this.status == DbStatusNoAuth {
+		return
+	}
+	this.status = DbStatusNoAuth
+	this.closeConns()
+	fmt.Printf("[close db] addr:%s, %s\n", this.addr, err)
+}
+
+// 关闭所有连接, 与 CloseDb 不同, 关闭后健康检查不再重新初始化
+func (this *Db) Close() {
+	if this.status == DbStatusClosed {
+		return
+	}
+	this.status = DbStatusClosed
+	this.closeConns()
+	this.breaker.Close()
+	fmt.Printf("[close db] addr:%s, db is closed\n", this.addr)
+}
+
+func (this *Db) closeConns() {
 	this.chanRWMutex.Lock()
+	initChan, extraChan := this.initConnChan, this.extraConnChan
 	this.initConnChan = nil
 	this.extraConnChan = nil
 	this.curWorkConnNum = 0
 	this.chanRWMutex.Unlock()
-	close(initChan)
-	for conn := range initChan {
-		if conn != nil {
-			conn.Close()
+	if initChan != nil {
+		close(initChan)
+		for conn := range initChan {
+			if conn != nil {
+				conn.Close()
+			}
 		}
 	}
-	close(extraChan)
-	for conn := range extraChan {
-		if conn != nil {
-			conn.Close()
+	if extraChan != nil {
+		close(extraChan)
+		for conn := range extraChan {
+			if conn != nil {
+				conn.Close()
+			}
 		}
 	}
+	this.closeMuxConns()
 	this.closeCheckConn()
-	fmt.Printf("[close db] addr:%s, db is down\n", this.addr)
 }
 
 func (this *Db) IsMaster() bool {
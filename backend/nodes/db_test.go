@@ -5,6 +5,8 @@ import (
 	"ncache/config"
 	"ncache/protocol"
 	"ncache/utils"
+	"net"
+	"sync"
 	"testing"
 )
 
@@ -32,8 +34,27 @@ func newDb(addr string) *Db {
 	return nil
 }
 
+// 关闭连接池时并发归还连接不会 panic, 所有连接最终都被关闭
 func TestDb_CloseDb(t *testing.T) {
-
+	db := &Db{initConnNum: 2, maxConnNum: 4, initConnChan: make(chan *Conn, 4), extraConnChan: make(chan *Conn, 4)}
+	conns := make([]*Conn, 100)
+	for i := range conns {
+		client, _ := net.Pipe()
+		conns[i] = &Conn{conn: client, status: connStatusConnected}
+	}
+	wg := &sync.WaitGroup{}
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn *Conn) {
+			defer wg.Done()
+			db.putConn(conn)
+		}(conn)
+	}
+	db.closeConns()
+	wg.Wait()
+	for _, conn := range conns {
+		utils.AssertMust(conn.IsClosed())
+	}
 }
 
 func TestDb_ProcCmdMsg(t *testing.T) {
@@ -0,0 +1,174 @@
+package nodes
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"ncache/protocol"
+)
+
+const (
+	defaultMuxQueueSize = 1024 // 单个连接上等待发送及等待响应的最大请求数
+	muxMaxBatch         = 128  // 写协程一次 flush 最多合并的请求数
+)
+
+// 复用连接上的一个请求, msgList 中的消息连续发送, 如 ASKING + 命令
+type muxReq struct {
+	msgList []*protocol.Msg
+	replies []*protocol.Msg
+	err     error
+	done    chan struct{}
+}
+
+func (this *muxReq) finish(replies []*protocol.Msg, err error) {
+	this.replies, this.err = replies, err
+	close(this.done)
+}
+
+// 多路复用连接, 类似 twemproxy:
+// 写协程从 reqChan 中批量取出请求写入后统一 flush, 并按写入顺序放入 pending,
+// 读协程按 FIFO 顺序读取响应并唤醒等待的请求
+type muxConn struct {
+	conn      *Conn
+	reqChan   chan *muxReq
+	pending   chan *muxReq
+	closeChan chan struct{}
+	closeOnce sync.Once
+	// 提交请求时持有读锁, 关闭后持有写锁清理未处理的请求
+	rwMutex sync.RWMutex
+	wg      sync.WaitGroup
+	closed  int32
+}
+
+func newMuxConn(conn *Conn) *muxConn {
+	mc := &muxConn{
+		conn:      conn,
+		reqChan:   make(chan *muxReq, defaultMuxQueueSize),
+		pending:   make(chan *muxReq, defaultMuxQueueSize),
+		closeChan: make(chan struct{}),
+	}
+	mc.wg.Add(2)
+	go mc.writeLoop()
+	go mc.readLoop()
+	go mc.cleanup()
+	return mc
+}
+
+// 发送一组消息并等待对应数量的响应
+func (this *muxConn) Do(msgList []*protocol.Msg) ([]*protocol.Msg, error) {
+	req := &muxReq{msgList: msgList, done: make(chan struct{})}
+	this.rwMutex.RLock()
+	if this.IsClosed() {
+		this.rwMutex.RUnlock()
+		return nil, errConnectClosed
+	}
+	select {
+	case this.reqChan <- req:
+	case <-this.closeChan:
+		this.rwMutex.RUnlock()
+		return nil, errConnectClosed
+	}
+	this.rwMutex.RUnlock()
+	<-req.done
+	return req.replies, req.err
+}
+
+func (this *muxConn) writeLoop() {
+	defer this.wg.Done()
+	for {
+		select {
+		case req := <-this.reqChan:
+			if !this.writeReq(req) {
+				return
+			}
+			// 合并已排队的请求, 只 flush 一次
+		batch:
+			for i := 1; i < muxMaxBatch; i++ {
+				select {
+				case req = <-this.reqChan:
+					if !this.writeReq(req) {
+						return
+					}
+				default:
+					break batch
+				}
+			}
+			if err := this.conn.bw.Flush(); err != nil {
+				this.Close()
+				return
+			}
+		case <-this.closeChan:
+			return
+		}
+	}
+}
+
+// 先放入 pending 再写入, 保证 pending 的顺序与写入顺序一致
+func (this *muxConn) writeReq(req *muxReq) bool {
+	select {
+	case this.pending <- req:
+	case <-this.closeChan:
+		req.finish(nil, errConnectClosed)
+		return false
+	}
+	for _, msg := range req.msgList {
+		if err := msg.WriteMsgBuffered(this.conn.bw); err != nil {
+			// 请求已在 pending 中, 由 cleanup 通知
+			this.Close()
+			return false
+		}
+	}
+	return true
+}
+
+func (this *muxConn) readLoop() {
+	defer this.wg.Done()
+	for {
+		select {
+		case req := <-this.pending:
+			replies := make([]*protocol.Msg, len(req.msgList))
+			for i := range replies {
+				var err error
+				if replies[i], err = protocol.NewMsgFromReader(this.conn.br); err != nil {
+					// 之后的响应已无法与请求对应, 关闭连接
+					req.finish(nil, err)
+					this.Close()
+					return
+				}
+			}
+			req.finish(replies, nil)
+		case <-this.closeChan:
+			return
+		}
+	}
+}
+
+// 读写协程退出后, 通知所有未完成的请求
+func (this *muxConn) cleanup() {
+	<-this.closeChan
+	this.wg.Wait()
+	this.rwMutex.Lock()
+	defer this.rwMutex.Unlock()
+	for {
+		select {
+		case req := <-this.pending:
+			req.finish(nil, errConnectClosed)
+		case req := <-this.reqChan:
+			req.finish(nil, errConnectClosed)
+		default:
+			return
+		}
+	}
+}
+
+func (this *muxConn) Close() {
+	this.closeOnce.Do(func() {
+		atomic.StoreInt32(&this.closed, 1)
+		close(this.closeChan)
+		this.conn.Close()
+	})
+}
+
+func (this *muxConn) IsClosed() bool {
+	return atomic.LoadInt32(&this.closed) == 1
+}
@@ -0,0 +1,80 @@
+package nodes
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"ncache/protocol"
+	"ncache/utils"
+)
+
+// 模拟 redis, ECHO 返回参数, 其他命令返回 OK
+func newMuxPipe(t *testing.T) (*muxConn, net.Conn) {
+	client, server := net.Pipe()
+	conn := &Conn{
+		conn:         client,
+		readTimeout:  1000,
+		writeTimeout: 1000,
+		status:       connStatusConnected,
+	}
+	conn.br = bufio.NewReader(conn)
+	conn.bw = bufio.NewWriter(conn)
+	go func() {
+		br := bufio.NewReader(server)
+		bw := bufio.NewWriter(server)
+		for {
+			msg, err := protocol.NewMsgFromReader(br)
+			if err != nil {
+				server.Close()
+				return
+			}
+			args, _ := msg.Args()
+			reply := protocol.MsgOK
+			if args[0] == "ECHO" {
+				reply = protocol.NewBulkStringMsg([]byte(args[1]))
+			}
+			if err = reply.WriteMsgBuffered(bw); err != nil {
+				return
+			}
+			if br.Buffered() == 0 {
+				bw.Flush()
+			}
+		}
+	}()
+	return newMuxConn(conn), server
+}
+
+func TestMuxConn_Do(t *testing.T) {
+	mc, _ := newMuxPipe(t)
+	defer mc.Close()
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value := strconv.Itoa(i)
+			replies, err := mc.Do([]*protocol.Msg{protocol.MsgAsking, protocol.NewCmdMsg("ECHO " + value)})
+			utils.AssertMustNoError(err)
+			utils.AssertMust(len(replies) == 2 && protocol.IsOkMsg(replies[0]))
+			str, err := replies[1].GetStr()
+			utils.AssertMustNoError(err)
+			utils.AssertMust(str == value)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMuxConn_Close(t *testing.T) {
+	mc, server := newMuxPipe(t)
+	_, err := mc.Do([]*protocol.Msg{protocol.NewCmdMsg("ECHO a")})
+	utils.AssertMustNoError(err)
+	server.Close()
+	_, err = mc.Do([]*protocol.Msg{protocol.NewCmdMsg("ECHO b")})
+	utils.AssertMust(err != nil)
+	utils.AssertMust(mc.IsClosed())
+	_, err = mc.Do([]*protocol.Msg{protocol.NewCmdMsg("ECHO c")})
+	utils.AssertMust(err == errConnectClosed)
+}
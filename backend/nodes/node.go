@@ -121,35 +121,34 @@ func (this *Node) RelayMsg(msg *protocol.Msg) (*protocol.Msg, error) {
 	return db.ProcCmdMsg(msg)
 }
 
-// 实现简单版, 串行执行
+// 多个请求在同一连接上 pipeline 执行
 func (this *Node) RelayMultiMsg(msgList []*protocol.Msg) (msg []*protocol.Msg, err error) {
 	if len(msgList) == 0 {
 		return nil, nil
 	}
-	var db *Db
-	switch this.mode {
-	case ModeSingle:
-		db = this.getDbByMsgFn(msgList[0])
-	case ModeMasterSlave:
-		for _, m := range msgList {
-			if filter.IsWriteCmdMsg(m) {
-				db = this.master
-				break
-			} else if db != nil {
-				db = this.getSlaveDbBalance()
-			}
-		}
+	return this.GetMultiDb(msgList).ProcMultiCmdMsg(msgList)
+}
+
+func (this *Node) Close() {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	if this.master != nil {
+		this.master.Close()
 	}
-	if db != nil {
-		return db.ProcMultiCmdMsg(msgList)
+	for _, slave := range this.slaves {
+		slave.Close()
 	}
-	return
 }
 
 func (this *Node) GetMasterAddress() string {
 	return this.conf.Master.Addr
 }
 
+// 迁移数据等需要读取最新数据的操作只能发往 master
+func (this *Node) GetMasterDb() *Db {
+	return this.master
+}
+
 func (this *Node) GetWeight() int {
 	return this.weight
 }
@@ -161,3 +160,16 @@ func (this *Node) GetName() string {
 func (this *Node) GetDb(msg *protocol.Msg) *Db {
 	return this.getDbByMsgFn(msg)
 }
+
+// 一组请求需发往同一个 db, 包含写命令时只能选择 master
+func (this *Node) GetMultiDb(msgList []*protocol.Msg) *Db {
+	if this.mode != ModeMasterSlave || this.SlaveLen() == 0 {
+		return this.master
+	}
+	for _, m := range msgList {
+		if filter.IsWriteCmdMsg(m) {
+			return this.master
+		}
+	}
+	return this.getSlaveDbBalance()
+}
@@ -0,0 +1,262 @@
+package route
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"ncache/backend"
+	"ncache/config"
+	"ncache/filter"
+	"ncache/protocol"
+	"ncache/stat"
+)
+
+// 迁移阶段
+const (
+	MigrateWriteBoth = "write_both" // 同时写新旧 backend, 读旧 backend
+	MigrateReadNew   = "read_new"   // 同时写新旧 backend, 读新 backend, key 不存在时读旧 backend
+	MigrateNewOnly   = "new_only"   // 只读写新 backend
+)
+
+var migratePhases = map[string]int32{
+	MigrateWriteBoth: 0,
+	MigrateReadNew:   1,
+	MigrateNewOnly:   2,
+}
+
+// 将 key 前缀从旧 backend 迁移到新 backend, 新 backend 按名称在处理请求时获取.
+// write_both 阶段以旧 backend 的响应为准, 之后以新 backend 为准
+type migrateBackend struct {
+	backend.Backend
+	target string
+	// 统计项名称, 如 migrate_feed_write_errors
+	statWriteErrors string
+	statFallbacks   string
+	phase           int32
+}
+
+func newMigrateBackend(name string, be backend.Backend, conf *config.MigrateConf) *migrateBackend {
+	mb := &migrateBackend{
+		Backend:         be,
+		target:          conf.Backend,
+		statWriteErrors: "migrate_" + name + "_write_errors",
+		statFallbacks:   "migrate_" + name + "_fallbacks",
+	}
+	mb.phase = migratePhases[migratePhase(conf)]
+	return mb
+}
+
+func migratePhase(conf *config.MigrateConf) string {
+	if conf.Phase == "" {
+		return MigrateWriteBoth
+	}
+	return strings.ToLower(conf.Phase)
+}
+
+// 目标 backend 需存在, 且不能是自身或同样处于迁移中的 backend
+func checkMigrates(confs map[string]config.Conf) error {
+	for name, conf := range confs {
+		migrate := conf.GetMigrate()
+		if migrate == nil {
+			continue
+		}
+		if _, ok := migratePhases[migratePhase(migrate)]; !ok {
+			return fmt.Errorf("backend %s: unknown migrate phase %s", name, migrate.Phase)
+		}
+		target, ok := confs[migrate.Backend]
+		if !ok || migrate.Backend == name {
+			return fmt.Errorf("backend %s: invalid migrate backend %s", name, migrate.Backend)
+		}
+		if target.GetMigrate() != nil {
+			return fmt.Errorf("backend %s: migrate backend %s is migrating", name, migrate.Backend)
+		}
+	}
+	return nil
+}
+
+func (this *migrateBackend) getPhase() int32 {
+	return atomic.LoadInt32(&this.phase)
+}
+
+func (this *migrateBackend) phaseName() string {
+	phase := this.getPhase()
+	for name, value := range migratePhases {
+		if value == phase {
+			return name
+		}
+	}
+	return ""
+}
+
+// 返回以其响应为准的 backend 及需要同时写入的 backend
+func (this *migrateBackend) backends(phase int32) (primary, secondary backend.Backend, err error) {
+	newBe, err := GetBackend(this.target)
+	switch phase {
+	case migratePhases[MigrateWriteBoth]:
+		// 新 backend 不可用时不影响旧 backend
+		if err != nil {
+			stat.Incr(this.statWriteErrors, 1)
+			return this.Backend, nil, nil
+		}
+		return this.Backend, newBe, nil
+	case migratePhases[MigrateReadNew]:
+		return newBe, this.Backend, err
+	default:
+		return newBe, nil, err
+	}
+}
+
+// 与 ProcPipeline 的处理逻辑相同
+func (this *migrateBackend) Proc(req *protocol.Msg) (*protocol.Msg, error) {
+	replies, err := this.ProcPipeline([]*protocol.Msg{req})
+	if len(replies) == 1 && replies[0] != nil {
+		return replies[0], nil
+	}
+	return nil, err
+}
+
+// 返回的响应与 reqs 一一对应, 处理失败的请求对应的响应为 nil, err 为第一个错误.
+// read_new 阶段读请求在新 backend 处理失败或 key 不存在时读旧 backend
+func (this *migrateBackend) ProcPipeline(reqs []*protocol.Msg) ([]*protocol.Msg, error) {
+	phase := this.getPhase()
+	primary, secondary, err := this.backends(phase)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		replies  []*protocol.Msg
+		fallback []int
+	)
+	if phase == migratePhases[MigrateReadNew] {
+		replies, fallback, err = readNew(primary, reqs)
+	} else {
+		replies, err = primary.ProcPipeline(reqs)
+	}
+	if len(replies) != len(reqs) {
+		replies = make([]*protocol.Msg, len(reqs))
+	}
+	var writes []*protocol.Msg
+	for i, req := range reqs {
+		if replies[i] != nil && isWriteMsg(req) {
+			writes = append(writes, req)
+		}
+	}
+	if secondary != nil && len(writes) > 0 {
+		if _, err := secondary.ProcPipeline(writes); err != nil {
+			stat.Incr(this.statWriteErrors, 1)
+		}
+	}
+	if len(fallback) > 0 {
+		stat.Incr(this.statFallbacks, int64(len(fallback)))
+		fallbackReqs := make([]*protocol.Msg, len(fallback))
+		for i, pos := range fallback {
+			fallbackReqs[i] = reqs[pos]
+		}
+		fallbackReplies, fallbackErr := this.Backend.ProcPipeline(fallbackReqs)
+		for i, pos := range fallback {
+			if i < len(fallbackReplies) && fallbackReplies[i] != nil {
+				replies[pos] = fallbackReplies[i]
+			}
+		}
+		if err == nil {
+			err = fallbackErr
+		}
+	}
+	for _, reply := range replies {
+		if reply == nil {
+			return replies, err
+		}
+	}
+	return replies, nil
+}
+
+// 在新 backend 中的每个读请求之前插入 EXISTS, 同一 pipeline 中执行.
+// 写入同时发往新旧 backend, 旧 backend 包含所有数据, 因此新 backend 中不存在的 key 需读旧 backend.
+// 返回与 reqs 对应的响应, 及需要读旧 backend 的请求下标
+func readNew(be backend.Backend, reqs []*protocol.Msg) (replies []*protocol.Msg, fallback []int, err error) {
+	var (
+		pipeline  = make([]*protocol.Msg, 0, 2*len(reqs))
+		positions = make([]int, len(reqs))
+		keyCounts = make([]int, len(reqs))
+	)
+	for i, req := range reqs {
+		if !isWriteMsg(req) {
+			if args, e := req.Args(); e == nil {
+				keys := filter.GetKeys(msgCmd(req), args)
+				if keyCounts[i] = len(keys); keyCounts[i] > 0 {
+					pipeline = append(pipeline, protocol.NewArrayMsgFormStrings(append([]string{"EXISTS"}, keys...)))
+				}
+			}
+		}
+		positions[i] = len(pipeline)
+		pipeline = append(pipeline, req)
+	}
+	acks, err := be.ProcPipeline(pipeline)
+	replies = make([]*protocol.Msg, len(reqs))
+	for i, req := range reqs {
+		pos := positions[i]
+		if pos < len(acks) {
+			replies[i] = acks[pos]
+		}
+		if isWriteMsg(req) {
+			continue
+		}
+		if replies[i] == nil {
+			fallback = append(fallback, i)
+			continue
+		}
+		if keyCounts[i] > 0 {
+			exists := acks[pos-1]
+			if exists == nil || !exists.IsInt() || exists.GetInt() < int64(keyCounts[i]) {
+				fallback = append(fallback, i)
+			}
+		}
+	}
+	return replies, fallback, err
+}
+
+func isWriteMsg(req *protocol.Msg) bool {
+	return filter.IsWriteCmd(msgCmd(req))
+}
+
+// 修改迁移阶段, 只在内存中生效, backend 配置变化重新加载后使用配置中的阶段
+func SetMigratePhase(name, phase string) error {
+	mb, err := getMigrateBackend(name)
+	if err != nil {
+		return err
+	}
+	value, ok := migratePhases[strings.ToLower(phase)]
+	if !ok {
+		return fmt.Errorf("unknown migrate phase %s", phase)
+	}
+	atomic.StoreInt32(&mb.phase, value)
+	return nil
+}
+
+func GetMigratePhase(name string) (string, error) {
+	mb, err := getMigrateBackend(name)
+	if err != nil {
+		return "", err
+	}
+	return mb.phaseName(), nil
+}
+
+func getMigrateBackend(name string) (*migrateBackend, error) {
+	be, err := GetBackend(name)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch b := be.(type) {
+		case *migrateBackend:
+			return b, nil
+		case *refBackend:
+			be = b.Backend
+		case *mirrorBackend:
+			be = b.Backend
+		default:
+			return nil, fmt.Errorf("backend %s is not migrating", name)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package route
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"ncache/config"
+	"ncache/protocol"
+	"ncache/utils"
+)
+
+func TestMigrateBackend(t *testing.T) {
+	oldBe := &fakeBackend{reply: protocol.NewBulkStringMsg([]byte("old"))}
+	newBe := &fakeBackend{reply: protocol.NewBulkStringMsg([]byte("new")), exists: map[string]bool{"b": true}}
+	rwLock.Lock()
+	BackendMap["migrate_test_new"] = newBe
+	BackendMap["migrate_test"] = newRefBackend(newMigrateBackend("migrate_test", oldBe, &config.MigrateConf{Backend: "migrate_test_new"}))
+	rwLock.Unlock()
+	defer func() {
+		rwLock.Lock()
+		delete(BackendMap, "migrate_test_new")
+		delete(BackendMap, "migrate_test")
+		rwLock.Unlock()
+	}()
+	be, err := GetBackend("migrate_test")
+	utils.AssertMustNoError(err)
+	getA, getB, set := protocol.NewCmdMsg("GET a"), protocol.NewCmdMsg("GET b"), protocol.NewCmdMsg("SET a 1")
+
+	// write_both: 读旧 backend, 写入两者
+	phase, err := GetMigratePhase("migrate_test")
+	utils.AssertMust(err == nil && phase == MigrateWriteBoth)
+	reply, err := be.Proc(getA)
+	utils.AssertMust(err == nil && reply == oldBe.reply)
+	_, err = be.Proc(set)
+	utils.AssertMustNoError(err)
+	utils.AssertMust(atomic.LoadInt64(&oldBe.count) == 2 && atomic.LoadInt64(&newBe.count) == 1)
+
+	// read_new: 按 key 是否存在于新 backend 决定是否读旧 backend, 与响应类型无关
+	utils.AssertMustNoError(SetMigratePhase("migrate_test", "read_new"))
+	reply, err = be.Proc(getA)
+	utils.AssertMust(err == nil && reply == oldBe.reply)
+	reply, err = be.Proc(getB)
+	utils.AssertMust(err == nil && reply == newBe.reply)
+	reply, err = be.Proc(protocol.NewCmdMsg("HGETALL a"))
+	utils.AssertMust(err == nil && reply == oldBe.reply)
+	replies, err := be.ProcPipeline([]*protocol.Msg{set, getA, getB})
+	utils.AssertMust(err == nil && replies[0] == newBe.reply && replies[1] == oldBe.reply && replies[2] == newBe.reply)
+
+	// 新 backend 出错时读请求读旧 backend, 失败的写请求对应的响应为 nil
+	newBe.err = errors.New("new backend err")
+	reply, err = be.Proc(getB)
+	utils.AssertMust(err == nil && reply == oldBe.reply)
+	replies, err = be.ProcPipeline([]*protocol.Msg{set, getB})
+	utils.AssertMust(err == newBe.err && len(replies) == 2 && replies[0] == nil && replies[1] == oldBe.reply)
+	newBe.err = nil
+
+	// new_only: 只访问新 backend
+	utils.AssertMustNoError(SetMigratePhase("migrate_test", "new_only"))
+	count := atomic.LoadInt64(&oldBe.count)
+	replies, err = be.ProcPipeline([]*protocol.Msg{set, getA})
+	utils.AssertMust(err == nil && replies[1] == newBe.reply)
+	utils.AssertMust(atomic.LoadInt64(&oldBe.count) == count)
+
+	utils.AssertMust(SetMigratePhase("migrate_test", "unknown") != nil)
+	utils.AssertMust(SetMigratePhase("migrate_test_new", "new_only") != nil)
+}
+
+func TestCheckMigrates(t *testing.T) {
+	confs := map[string]config.Conf{
+		"a": config.SliceConf{Migrate: &config.MigrateConf{Backend: "b", Phase: "READ_NEW"}},
+		"b": config.ClusterConf{},
+	}
+	utils.AssertMustNoError(checkMigrates(confs))
+	confs["a"] = config.SliceConf{Migrate: &config.MigrateConf{Backend: "b", Phase: "read_old"}}
+	utils.AssertMust(checkMigrates(confs) != nil)
+	confs["a"] = config.SliceConf{Migrate: &config.MigrateConf{Backend: "a"}}
+	utils.AssertMust(checkMigrates(confs) != nil)
+}
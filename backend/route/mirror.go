@@ -0,0 +1,200 @@
+package route
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+
+	"ncache/backend"
+	"ncache/config"
+	"ncache/filter"
+	"ncache/protocol"
+	"ncache/stat"
+)
+
+const (
+	mirrorModeAll   = "all"
+	mirrorModeRead  = "read"
+	mirrorModeWrite = "write"
+
+	defaultMirrorQueueSize = 1024
+	defaultMirrorWorkers   = 4
+)
+
+type mirrorReq struct {
+	req   *protocol.Msg
+	reply *protocol.Msg
+}
+
+// 将处理成功的请求按比例放入队列, 由单独的协程转发到目标 backend.
+// 队列满时直接丢弃, 目标 backend 的响应及耗时不影响原请求
+type mirrorBackend struct {
+	backend.Backend
+	target    string
+	mode      string
+	rate      float64
+	queue     chan mirrorReq
+	closeChan chan struct{}
+	closeOnce sync.Once
+	// 统计项名称, 如 mirror_feed_requests
+	statRequests   string
+	statErrors     string
+	statMismatches string
+	statDropped    string
+	compare        bool
+}
+
+func newMirrorBackend(name string, be backend.Backend, conf *config.MirrorConf) *mirrorBackend {
+	mb := &mirrorBackend{
+		Backend:        be,
+		target:         conf.Backend,
+		mode:           strings.ToLower(conf.Mode),
+		rate:           conf.Rate,
+		closeChan:      make(chan struct{}),
+		statRequests:   "mirror_" + name + "_requests",
+		statErrors:     "mirror_" + name + "_errors",
+		statMismatches: "mirror_" + name + "_mismatches",
+		statDropped:    "mirror_" + name + "_dropped",
+		compare:        conf.Compare,
+	}
+	if mb.mode == "" {
+		mb.mode = mirrorModeAll
+	}
+	queueSize, workers := conf.QueueSize, conf.Workers
+	if queueSize <= 0 {
+		queueSize = defaultMirrorQueueSize
+	}
+	if workers <= 0 {
+		workers = defaultMirrorWorkers
+	}
+	mb.queue = make(chan mirrorReq, queueSize)
+	for i := 0; i < workers; i++ {
+		go mb.worker()
+	}
+	return mb
+}
+
+// 目标 backend 需存在, 且不能是自身或同样配置了复制的 backend, 避免循环复制
+func checkMirrors(confs map[string]config.Conf) error {
+	for name, conf := range confs {
+		mirror := conf.GetMirror()
+		if mirror == nil {
+			continue
+		}
+		switch strings.ToLower(mirror.Mode) {
+		case "", mirrorModeAll, mirrorModeRead, mirrorModeWrite:
+		default:
+			return fmt.Errorf("backend %s: unknown mirror mode %s", name, mirror.Mode)
+		}
+		if mirror.Rate <= 0 || mirror.Rate > 1 {
+			return fmt.Errorf("backend %s: mirror rate must be in (0, 1]", name)
+		}
+		target, ok := confs[mirror.Backend]
+		if !ok || mirror.Backend == name {
+			return fmt.Errorf("backend %s: invalid mirror backend %s", name, mirror.Backend)
+		}
+		if target.GetMirror() != nil {
+			return fmt.Errorf("backend %s: mirror backend %s must not be mirrored", name, mirror.Backend)
+		}
+	}
+	return nil
+}
+
+func (this *mirrorBackend) Proc(req *protocol.Msg) (*protocol.Msg, error) {
+	reply, err := this.Backend.Proc(req)
+	if err == nil {
+		this.mirror(req, reply)
+	}
+	return reply, err
+}
+
+func (this *mirrorBackend) ProcPipeline(reqs []*protocol.Msg) ([]*protocol.Msg, error) {
+	replies, err := this.Backend.ProcPipeline(reqs)
+	if err == nil {
+		for i, req := range reqs {
+			if replies[i] != nil {
+				this.mirror(req, replies[i])
+			}
+		}
+	}
+	return replies, err
+}
+
+func (this *mirrorBackend) mirror(req, reply *protocol.Msg) {
+	if !this.sample(req) {
+		return
+	}
+	select {
+	case this.queue <- mirrorReq{req: req, reply: reply}:
+	default:
+		stat.Incr(this.statDropped, 1)
+	}
+}
+
+func (this *mirrorBackend) sample(req *protocol.Msg) bool {
+	if this.rate < 1 && rand.Float64() >= this.rate {
+		return false
+	}
+	if this.mode == mirrorModeAll {
+		return true
+	}
+	if this.mode == mirrorModeRead {
+		return filter.IsReadCmd(msgCmd(req))
+	}
+	return filter.IsWriteCmd(msgCmd(req))
+}
+
+// 请求的命令名, 大写
+func msgCmd(req *protocol.Msg) string {
+	array := req.GetArray()
+	if len(array) == 0 {
+		return ""
+	}
+	cmdBytes, _ := array[0].GetValueBytes()
+	return strings.ToUpper(string(cmdBytes))
+}
+
+func (this *mirrorBackend) worker() {
+	for {
+		select {
+		case mr := <-this.queue:
+			this.replay(mr)
+		case <-this.closeChan:
+			return
+		}
+	}
+}
+
+// 每次转发时重新获取目标 backend, 重新加载配置后使用新的 backend
+func (this *mirrorBackend) replay(mr mirrorReq) {
+	stat.Incr(this.statRequests, 1)
+	be, err := GetBackend(this.target)
+	if err != nil {
+		stat.Incr(this.statErrors, 1)
+		return
+	}
+	reply, err := be.Proc(mr.req)
+	if err != nil {
+		stat.Incr(this.statErrors, 1)
+		return
+	}
+	if this.compare && !sameReply(mr.reply, reply) {
+		stat.Incr(this.statMismatches, 1)
+	}
+}
+
+func sameReply(reply1, reply2 *protocol.Msg) bool {
+	b1, err1 := reply1.WriteToBytes()
+	b2, err2 := reply2.WriteToBytes()
+	return err1 == nil && err2 == nil && bytes.Equal(b1, b2)
+}
+
+// 未复制的请求直接丢弃
+func (this *mirrorBackend) Close() {
+	this.closeOnce.Do(func() {
+		close(this.closeChan)
+	})
+	this.Backend.Close()
+}
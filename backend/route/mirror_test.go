@@ -0,0 +1,123 @@
+package route
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ncache/backend/nodes"
+	"ncache/config"
+	"ncache/protocol"
+	"ncache/stat"
+	"ncache/utils"
+)
+
+// 返回固定响应, 记录处理的请求数.
+// exists 不为 nil 时按其中的 key 响应 EXISTS, 不计入请求数; err 不为 nil 时所有请求返回该错误
+type fakeBackend struct {
+	reply  *protocol.Msg
+	delay  time.Duration
+	count  int64
+	exists map[string]bool
+	err    error
+}
+
+func (this *fakeBackend) Proc(req *protocol.Msg) (*protocol.Msg, error) {
+	if this.exists != nil && msgCmd(req) == "EXISTS" {
+		var n int64
+		for _, key := range req.GetArray()[1:] {
+			if value, _ := key.GetValueBytes(); this.exists[string(value)] {
+				n++
+			}
+		}
+		return protocol.NewIntegerMsg(n), nil
+	}
+	time.Sleep(this.delay)
+	atomic.AddInt64(&this.count, 1)
+	if this.err != nil {
+		return nil, this.err
+	}
+	return this.reply, nil
+}
+
+func (this *fakeBackend) ProcPipeline(reqs []*protocol.Msg) ([]*protocol.Msg, error) {
+	var err error
+	replies := make([]*protocol.Msg, len(reqs))
+	for i, req := range reqs {
+		var e error
+		if replies[i], e = this.Proc(req); e != nil && err == nil {
+			err = e
+		}
+	}
+	return replies, err
+}
+
+func (this *fakeBackend) GetNodeIndexByKey([]byte) uint32 { return 0 }
+func (this *fakeBackend) ForwardMsg(uint32, *protocol.Msg) (*protocol.Msg, error) {
+	return nil, nil
+}
+func (this *fakeBackend) ForwardMultiMsg(uint32, []*protocol.Msg) ([]*protocol.Msg, error) {
+	return nil, nil
+}
+func (this *fakeBackend) GetNodes() []*nodes.Node { return nil }
+func (this *fakeBackend) GetConf() interface{}    { return nil }
+func (this *fakeBackend) Close()                  {}
+
+func waitCount(be *fakeBackend, count int64) bool {
+	for i := 0; i < 100; i++ {
+		if atomic.LoadInt64(&be.count) >= count {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestMirrorBackend(t *testing.T) {
+	primary := &fakeBackend{reply: protocol.NewBulkStringMsg([]byte("v1"))}
+	shadow := &fakeBackend{reply: protocol.NewBulkStringMsg([]byte("v2")), delay: 50 * time.Millisecond}
+	rwLock.Lock()
+	BackendMap["mirror_test_shadow"] = shadow
+	rwLock.Unlock()
+	defer func() {
+		rwLock.Lock()
+		delete(BackendMap, "mirror_test_shadow")
+		rwLock.Unlock()
+	}()
+	mb := newMirrorBackend("mirror_test", primary, &config.MirrorConf{
+		Backend: "mirror_test_shadow",
+		Rate:    1,
+		Mode:    "read",
+		Compare: true,
+	})
+	defer mb.Close()
+
+	// 目标 backend 较慢时不影响原请求
+	start := time.Now()
+	reply, err := mb.Proc(protocol.NewCmdMsg("GET a"))
+	utils.AssertMust(err == nil && reply == primary.reply)
+	utils.AssertMust(time.Since(start) < 40*time.Millisecond)
+	_, err = mb.ProcPipeline([]*protocol.Msg{protocol.NewCmdMsg("SET a 1"), protocol.NewCmdMsg("GET b")})
+	utils.AssertMustNoError(err)
+	utils.AssertMust(waitCount(shadow, 2))
+	time.Sleep(20 * time.Millisecond)
+	utils.AssertMust(atomic.LoadInt64(&shadow.count) == 2)
+	utils.AssertMust(stat.Get("mirror_mirror_test_mismatches") == 2)
+}
+
+func TestCheckMirrors(t *testing.T) {
+	confs := map[string]config.Conf{
+		"a": config.SliceConf{Mirror: &config.MirrorConf{Backend: "b", Rate: 0.1}},
+		"b": config.SliceConf{},
+	}
+	utils.AssertMustNoError(checkMirrors(confs))
+	confs["b"] = config.SliceConf{Mirror: &config.MirrorConf{Backend: "a", Rate: 0.1}}
+	utils.AssertMust(checkMirrors(confs) != nil)
+	confs["b"] = config.SliceConf{}
+	confs["a"] = config.SliceConf{Mirror: &config.MirrorConf{Backend: "c", Rate: 0.1}}
+	utils.AssertMust(checkMirrors(confs) != nil)
+	confs["a"] = config.SliceConf{Mirror: &config.MirrorConf{Backend: "b", Rate: 0}}
+	utils.AssertMust(checkMirrors(confs) != nil)
+	confs["a"] = config.SliceConf{Mirror: &config.MirrorConf{Backend: "b", Rate: 1, Mode: "both"}}
+	utils.AssertMust(checkMirrors(confs) != nil)
+}
@@ -0,0 +1,78 @@
+package route
+
+import (
+	"fmt"
+	"reflect"
+
+	"ncache/backend"
+	"ncache/backend/slice"
+	"ncache/config"
+)
+
+// 去掉 ref, mirror 及 migrate 包装, 不是 slice 时返回 nil
+func getSlice(be backend.Backend) *slice.Slice {
+	for {
+		switch b := be.(type) {
+		case *slice.Slice:
+			return b
+		case *refBackend:
+			be = b.Backend
+		case *mirrorBackend:
+			be = b.Backend
+		case *migrateBackend:
+			be = b.Backend
+		default:
+			return nil
+		}
+	}
+}
+
+// 重新分片完成前不能再次修改该 backend 的配置, 否则未迁移的 key 将无法读取
+func checkRebalances(confs, oldConfs map[string]config.Conf) error {
+	rwLock.RLock()
+	defer rwLock.RUnlock()
+	for name, conf := range confs {
+		if oldConf, ok := oldConfs[name]; !ok || reflect.DeepEqual(oldConf, conf) {
+			continue
+		}
+		if s := getSlice(BackendMap[name]); s != nil && s.IsRebalancing() {
+			return fmt.Errorf("backend %s is rebalancing", name)
+		}
+	}
+	return nil
+}
+
+// 新旧 backend 均为 slice 且需要重新分片时, 旧 backend 交由新 backend 在迁移完成后关闭
+func startRebalance(name string, oldBe, newBe backend.Backend) bool {
+	oldSlice, newSlice := getSlice(oldBe), getSlice(newBe)
+	if oldSlice == nil || newSlice == nil {
+		return false
+	}
+	return newSlice.StartRebalance(name, oldSlice, func() {
+		retireBackend(oldBe)
+	})
+}
+
+func retireBackend(be backend.Backend) {
+	if rb, ok := be.(*refBackend); ok {
+		go rb.closeWhenIdle()
+	} else {
+		be.Close()
+	}
+}
+
+func GetRebalanceProgress(name string) (*slice.RebalanceProgress, error) {
+	be, err := GetBackend(name)
+	if err != nil {
+		return nil, err
+	}
+	s := getSlice(be)
+	if s == nil {
+		return nil, fmt.Errorf("backend %s is not a slice", name)
+	}
+	progress := s.GetRebalanceProgress()
+	if progress == nil {
+		return nil, fmt.Errorf("backend %s is not rebalanced", name)
+	}
+	return progress, nil
+}
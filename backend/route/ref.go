@@ -0,0 +1,52 @@
+package route
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/janic716/golib/log"
+	"ncache/backend"
+	"ncache/protocol"
+)
+
+const (
+	// 替换后客户端可能仍持有旧的 backend, 至少等待该时间再关闭
+	retireGraceTime = time.Second
+	// 请求一直未处理完时, 最长等待时间
+	retireMaxWaitTime   = 60 * time.Second
+	retireCheckInterval = 100 * time.Millisecond
+)
+
+// 记录正在处理的请求数, 重新加载后被替换的 backend 在请求处理完后关闭
+type refBackend struct {
+	backend.Backend
+	refs int64
+}
+
+func newRefBackend(be backend.Backend) *refBackend {
+	return &refBackend{Backend: be}
+}
+
+func (this *refBackend) Proc(req *protocol.Msg) (*protocol.Msg, error) {
+	atomic.AddInt64(&this.refs, 1)
+	defer atomic.AddInt64(&this.refs, -1)
+	return this.Backend.Proc(req)
+}
+
+func (this *refBackend) ProcPipeline(reqs []*protocol.Msg) ([]*protocol.Msg, error) {
+	atomic.AddInt64(&this.refs, 1)
+	defer atomic.AddInt64(&this.refs, -1)
+	return this.Backend.ProcPipeline(reqs)
+}
+
+func (this *refBackend) closeWhenIdle() {
+	time.Sleep(retireGraceTime)
+	deadline := time.Now().Add(retireMaxWaitTime)
+	for atomic.LoadInt64(&this.refs) > 0 && time.Now().Before(deadline) {
+		time.Sleep(retireCheckInterval)
+	}
+	if refs := atomic.LoadInt64(&this.refs); refs > 0 {
+		log.Warningf("close retired backend with %d requests in process", refs)
+	}
+	this.Close()
+}
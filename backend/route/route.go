@@ -3,13 +3,17 @@ package route
 import (
 	"errors"
 	"fmt"
+	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"ncache/backend"
 	"ncache/backend/clusters"
 	"ncache/backend/slice"
 	"ncache/config"
+	"ncache/filter"
+	"ncache/rule"
 	"github.com/janic716/golib/log"
 )
 
@@ -17,6 +21,9 @@ import (
 var (
 	BackendMap map[string]backend.Backend
 	rwLock     sync.RWMutex
+	version    uint64
+	// backend 允许执行的命令, 与 BackendMap 一同替换
+	cmdAllowlists map[string]*filter.CmdAllowlist
 )
 
 func init() {
@@ -25,41 +32,176 @@ func init() {
 
 func InitBackendMap() error {
 	confs := config.GetBackendConfs()
+	if err := checkMirrors(confs); err != nil {
+		return err
+	}
+	if err := checkMigrates(confs); err != nil {
+		return err
+	}
+	allowlists, err := newCmdAllowlists(confs)
+	if err != nil {
+		return err
+	}
+	rwLock.Lock()
+	cmdAllowlists = allowlists
+	rwLock.Unlock()
 	for name, conf := range confs {
 		log.Infof("init backend: %s", name)
-		t := conf.GetType()
-		switch strings.ToLower(t) {
-		case config.TypeCluster:
-			value, ok := conf.(config.ClusterConf)
-			if !ok {
-				return errors.New("conf type wrong")
-			}
-			c, err := cluster.NewClusterWithConf(value)
+		be, err := newBackend(name, conf)
+		if err != nil {
+			return err
+		}
+		if be == nil {
+			continue
+		}
+		rwLock.Lock()
+		BackendMap[name] = be
+		rwLock.Unlock()
+	}
+	return nil
+}
+
+// 未配置 commands 的 backend 不限制
+func newCmdAllowlists(confs map[string]config.Conf) (map[string]*filter.CmdAllowlist, error) {
+	allowlists := make(map[string]*filter.CmdAllowlist)
+	for name, conf := range confs {
+		if cmds := conf.GetCommands(); len(cmds) > 0 {
+			allowlist, err := filter.NewCmdAllowlist(cmds)
 			if err != nil {
-				return err
-			}
-			rwLock.Lock()
-			BackendMap[name] = c
-			rwLock.Unlock()
-		case config.TypeSlice:
-			value, ok := conf.(config.SliceConf)
-			if !ok {
-				return errors.New("conf type wrong")
+				return nil, fmt.Errorf("backend %s: %s", name, err)
 			}
-			s, err := slice.NewSlice(value)
-			if err != nil {
-				return err
+			allowlists[name] = allowlist
+		}
+	}
+	return allowlists, nil
+}
+
+// 按配置依次包装为 migrateBackend 及 mirrorBackend
+func wrapBackend(name string, be backend.Backend, conf config.Conf) backend.Backend {
+	if migrate := conf.GetMigrate(); migrate != nil {
+		be = newMigrateBackend(name, be, migrate)
+	}
+	if mirror := conf.GetMirror(); mirror != nil {
+		be = newMirrorBackend(name, be, mirror)
+	}
+	return newRefBackend(be)
+}
+
+func newBackend(name string, conf config.Conf) (backend.Backend, error) {
+	t := conf.GetType()
+	switch strings.ToLower(t) {
+	case config.TypeCluster:
+		value, ok := conf.(config.ClusterConf)
+		if !ok {
+			return nil, errors.New("conf type wrong")
+		}
+		// 以 backend 的名称为准, 节点的统计项按此区分
+		value.Name = name
+		c, err := cluster.NewClusterWithConf(value)
+		if err != nil {
+			return nil, err
+		}
+		return wrapBackend(name, c, conf), nil
+	case config.TypeSlice:
+		value, ok := conf.(config.SliceConf)
+		if !ok {
+			return nil, errors.New("conf type wrong")
+		}
+		value.Name = name
+		s, err := slice.NewSlice(value)
+		if err != nil {
+			return nil, err
+		}
+		return wrapBackend(name, s, conf), nil
+	default:
+		log.Warningf("unknow  conf type. backend:%s, type:%s", t, name)
+	}
+	return nil, nil
+}
+
+// 对比新旧配置, 只重建有变化的 backend, 全部创建成功后一次性替换.
+// 被替换或删除的 backend 在请求处理完后关闭
+func Reload(confs map[string]config.Conf) error {
+	oldConfs := config.GetBackendConfs()
+	if err := checkMirrors(confs); err != nil {
+		return err
+	}
+	if err := checkMigrates(confs); err != nil {
+		return err
+	}
+	if err := checkRebalances(confs, oldConfs); err != nil {
+		return err
+	}
+	allowlists, err := newCmdAllowlists(confs)
+	if err != nil {
+		return err
+	}
+	newBackends := make(map[string]backend.Backend)
+	for name, conf := range confs {
+		if oldConf, ok := oldConfs[name]; ok && reflect.DeepEqual(oldConf, conf) {
+			continue
+		}
+		log.Infof("reload backend: %s", name)
+		be, err := newBackend(name, conf)
+		if err != nil {
+			for _, be := range newBackends {
+				be.Close()
 			}
-			rwLock.Lock()
-			BackendMap[name] = s
-			rwLock.Unlock()
-		default:
-			log.Warningf("unknow  conf type. backend:%s, type:%s", t, name)
+			return fmt.Errorf("reload backend %s: %s", name, err)
+		}
+		if be != nil {
+			newBackends[name] = be
 		}
 	}
+
+	var (
+		retired    []backend.Backend
+		rebalanced int
+	)
+	rwLock.Lock()
+	backendMap := make(map[string]backend.Backend, len(confs))
+	for name, be := range BackendMap {
+		newBe, changed := newBackends[name]
+		if changed && startRebalance(name, be, newBe) {
+			rebalanced++
+			continue
+		}
+		if _, ok := confs[name]; !ok || changed {
+			retired = append(retired, be)
+			continue
+		}
+		backendMap[name] = be
+	}
+	for name, be := range newBackends {
+		backendMap[name] = be
+	}
+	BackendMap = backendMap
+	cmdAllowlists = allowlists
+	atomic.AddUint64(&version, 1)
+	rwLock.Unlock()
+
+	for _, be := range retired {
+		retireBackend(be)
+	}
+	log.Infof("reload backend finished, changed: %d, retired: %d, rebalancing: %d", len(newBackends), len(retired), rebalanced)
 	return nil
 }
 
+// backend 每次重新加载后递增, 客户端据此判断缓存的 backend 是否失效
+func GetVersion() uint64 {
+	return atomic.LoadUint64(&version)
+}
+
+// 关闭所有 backend, 用于服务退出
+func CloseBackends() {
+	rwLock.Lock()
+	defer rwLock.Unlock()
+	for name, be := range BackendMap {
+		log.Infof("close backend: %s", name)
+		be.Close()
+	}
+}
+
 // todo 异步的去初始化backend
 func AsynInitBackend(index string) {
 
@@ -76,7 +218,37 @@ func GetBackend(index string) (be backend.Backend, err error) {
 	return be, nil
 }
 
-func GetIndex(key string) (index string) {
+// backend 是否允许执行该命令, 不存在的 backend 由路由时报错
+func IsCmdAllowed(index, cmd string) bool {
+	rwLock.RLock()
+	defer rwLock.RUnlock()
+	return cmdAllowlists[index].Allow(cmd)
+}
+
+// 按路由规则选择 backend, 不考虑命令规则
+func GetIndex(key string) string {
+	return GetIndexByCmd("", key)
+}
+
+// 第一个匹配的路由规则生效, 没有匹配的规则时使用 key 中 : 之前的前缀
+func GetIndexByCmd(cmd, key string) string {
+	if index, ok := rule.GetRouteTable().Resolve(cmd, key); ok {
+		return index
+	}
+	return prefixIndex(key)
+}
+
+// 列出路由规则的匹配过程及最终选择的 backend, 用于调试
+func Explain(cmd, key string) []string {
+	table := rule.GetRouteTable()
+	lines := table.Explain(cmd, key)
+	if _, ok := table.Resolve(cmd, key); !ok {
+		lines = append(lines, "no rule matched, use key prefix, backend "+prefixIndex(key))
+	}
+	return lines
+}
+
+func prefixIndex(key string) (index string) {
 	pos := strings.Index(key, ":")
 	if pos == -1 {
 		index = "default"
@@ -1,6 +1,7 @@
 package slice
 
 import (
+	"ncache/backend/command"
 	"ncache/protocol"
 )
 
@@ -8,3 +9,32 @@ func (s *Slice) ForwardMsg(index uint32, msg *protocol.Msg) (msgAck *protocol.Ms
 	node := s.GetNodeByIndex(index)
 	return node.RelayMsg(msg)
 }
+
+func (s *Slice) ForwardMultiMsg(index uint32, msgList []*protocol.Msg) (msgAckList []*protocol.Msg, err error) {
+	node := s.GetNodeByIndex(index)
+	return node.RelayMultiMsg(msgList)
+}
+
+func (s *Slice) ProcPipeline(msgList []*protocol.Msg) (msgAckList []*protocol.Msg, err error) {
+	if r := s.getRebalancer(); r != nil {
+		return r.procPipeline(msgList)
+	}
+	return s.procPipeline(msgList)
+}
+
+func (s *Slice) procPipeline(msgList []*protocol.Msg) (msgAckList []*protocol.Msg, err error) {
+	// Polling 模式下所有命令均视为单 key 命令
+	if s.mode == Polling {
+		return command.ForwardByIndex(s, msgList)
+	}
+	return command.PipelineProc(directSlice{s}, msgList, nil)
+}
+
+// pipeline 中的多 key 命令直接处理, 重新分片时已由 rebalancer 迁移涉及的 key
+type directSlice struct {
+	*Slice
+}
+
+func (s directSlice) Proc(msg *protocol.Msg) (*protocol.Msg, error) {
+	return s.Slice.proc(msg)
+}
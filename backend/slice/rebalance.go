@@ -0,0 +1,453 @@
+package slice
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/janic716/golib/log"
+	"ncache/backend/nodes"
+	"ncache/filter"
+	"ncache/protocol"
+	"ncache/stat"
+)
+
+const (
+	defaultRebalanceScanCount  = 100
+	defaultRebalanceKeysPerSec = 1000
+	rebalanceLockNum           = 64
+	// SCAN 失败后的重试间隔
+	rebalanceRetryInterval = time.Second
+)
+
+// 重新分片的进度
+type RebalanceProgress struct {
+	Scanned int64
+	Moved   int64
+	Failed  int64
+	// 正在扫描的旧节点下标及旧节点总数
+	Node  int
+	Nodes int
+	Done  bool
+}
+
+// 节点变化后, 将归属变化的 key 从旧 slice 迁移到新 slice.
+// 迁移完成前, GET 先读新节点, 返回 nil 时读旧节点; 其余请求 (包括读请求) 先同步迁移涉及的 key,
+// 因为 HGETALL, EXISTS, TTL 等命令在 key 不存在时也返回正常的空值, 无法据此判断是否未命中.
+// 后台协程依次 SCAN 旧节点的 master 并按限速迁移, 完成后关闭旧 slice
+type rebalancer struct {
+	slice     *Slice
+	old       *Slice
+	closeOld  func()
+	scanCount int
+	interval  time.Duration
+	// 同一 key 的迁移与写请求互斥, 避免写入后被迁移的旧值覆盖
+	locks     [rebalanceLockNum]sync.Mutex
+	closeChan chan struct{}
+	closeOnce sync.Once
+	// 统计项名称, 如 rebalance_feed_moved
+	statMoved  string
+	statFailed string
+	scanned    int64
+	moved      int64
+	failed     int64
+	node       int32
+	done       int32
+}
+
+// 以 old 为迁移来源开始重新分片, 未配置 rebalance 或节点分布未变化时返回 false.
+// 迁移完成或 slice 关闭后调用 closeOld 关闭旧 slice
+func (s *Slice) StartRebalance(name string, old *Slice, closeOld func()) bool {
+	conf := s.conf.Rebalance
+	if conf == nil || s.mode != KeyDispatch || old.mode != KeyDispatch || sameLayout(s, old) {
+		return false
+	}
+	r := &rebalancer{
+		slice:      s,
+		old:        old,
+		closeOld:   closeOld,
+		scanCount:  conf.ScanCount,
+		closeChan:  make(chan struct{}),
+		statMoved:  "rebalance_" + name + "_moved",
+		statFailed: "rebalance_" + name + "_failed",
+	}
+	if r.scanCount <= 0 {
+		r.scanCount = defaultRebalanceScanCount
+	}
+	keysPerSec := conf.MaxKeysPerSec
+	if keysPerSec <= 0 {
+		keysPerSec = defaultRebalanceKeysPerSec
+	}
+	r.interval = time.Second / time.Duration(keysPerSec)
+	s.rebalance = r
+	log.Infof("rebalance backend %s start, nodes: %d -> %d", name, len(old.nodes), len(s.nodes))
+	go r.run(name)
+	return true
+}
+
+// 哈希环及各下标对应的 master 均相同时, key 的归属不变
+func sameLayout(s1, s2 *Slice) bool {
+	if len(s1.nodes) != len(s2.nodes) || !reflect.DeepEqual(s1.continuums, s2.continuums) {
+		return false
+	}
+	for i := range s1.nodes {
+		if s1.nodes[i].GetMasterAddress() != s2.nodes[i].GetMasterAddress() {
+			return false
+		}
+	}
+	return true
+}
+
+// 迁移未完成时返回 rebalancer, 否则返回 nil
+func (s *Slice) getRebalancer() *rebalancer {
+	if s.rebalance == nil || atomic.LoadInt32(&s.rebalance.done) == 1 {
+		return nil
+	}
+	return s.rebalance
+}
+
+func (s *Slice) IsRebalancing() bool {
+	return s.getRebalancer() != nil
+}
+
+// 未进行过重新分片时返回 nil
+func (s *Slice) GetRebalanceProgress() *RebalanceProgress {
+	r := s.rebalance
+	if r == nil {
+		return nil
+	}
+	return &RebalanceProgress{
+		Scanned: atomic.LoadInt64(&r.scanned),
+		Moved:   atomic.LoadInt64(&r.moved),
+		Failed:  atomic.LoadInt64(&r.failed),
+		Node:    int(atomic.LoadInt32(&r.node)),
+		Nodes:   len(r.old.nodes),
+		Done:    atomic.LoadInt32(&r.done) == 1,
+	}
+}
+
+func (this *rebalancer) close() {
+	this.closeOnce.Do(func() {
+		close(this.closeChan)
+	})
+}
+
+func (this *rebalancer) isClosed() bool {
+	select {
+	case <-this.closeChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// 等待 d, slice 关闭时返回 false
+func (this *rebalancer) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-this.closeChan:
+		return false
+	}
+}
+
+func (this *rebalancer) run(name string) {
+	for i, node := range this.old.nodes {
+		atomic.StoreInt32(&this.node, int32(i))
+		if !this.scanNode(node) {
+			break
+		}
+	}
+	atomic.StoreInt32(&this.done, 1)
+	p := this.slice.GetRebalanceProgress()
+	if this.isClosed() {
+		log.Warningf("rebalance backend %s stopped, scanned: %d, moved: %d, failed: %d", name, p.Scanned, p.Moved, p.Failed)
+	} else {
+		log.Infof("rebalance backend %s finished, scanned: %d, moved: %d, failed: %d", name, p.Scanned, p.Moved, p.Failed)
+	}
+	this.closeOld()
+}
+
+// 扫描旧节点的所有 key, slice 关闭时返回 false
+func (this *rebalancer) scanNode(node *nodes.Node) bool {
+	db := node.GetMasterDb()
+	cursor := "0"
+	for {
+		if this.isClosed() {
+			return false
+		}
+		reply, err := db.ProcCmdMsg(newCmdMsg("SCAN", cursor, "COUNT", strconv.Itoa(this.scanCount)))
+		var keys []string
+		if err == nil {
+			cursor, keys, err = parseScanReply(reply)
+		}
+		if err != nil {
+			log.Warningf("rebalance scan %s failed: %s", node.GetMasterAddress(), err)
+			if !this.sleep(rebalanceRetryInterval) {
+				return false
+			}
+			continue
+		}
+		for _, key := range keys {
+			atomic.AddInt64(&this.scanned, 1)
+			if this.owners(key) == nil {
+				continue
+			}
+			unlock := this.lockKeys([]string{key})
+			err := this.moveKey(key)
+			unlock()
+			if err != nil {
+				log.Warningf("rebalance key %s failed: %s", key, err)
+			}
+			if !this.sleep(this.interval) {
+				return false
+			}
+		}
+		if cursor == "0" {
+			return true
+		}
+	}
+}
+
+// SCAN 的响应为 [cursor, [key ...]]
+func parseScanReply(reply *protocol.Msg) (cursor string, keys []string, err error) {
+	if reply.IsError() {
+		msg, _ := reply.GetError()
+		return "", nil, errors.New(msg)
+	}
+	array := reply.GetArray()
+	if len(array) != 2 {
+		return "", nil, fmt.Errorf("unexpected scan reply %s", reply)
+	}
+	value, _ := array[0].GetValueBytes()
+	cursor = string(value)
+	for _, m := range array[1].GetArray() {
+		value, _ = m.GetValueBytes()
+		keys = append(keys, string(value))
+	}
+	return cursor, keys, nil
+}
+
+// key 所在节点变化时返回新旧节点, 否则返回 nil
+func (this *rebalancer) owners(key string) []*nodes.Node {
+	oldNode := this.old.GetNodeByIndex(this.old.GetNodeIndexByKey([]byte(key)))
+	newNode := this.slice.GetNodeByIndex(this.slice.GetNodeIndexByKey([]byte(key)))
+	if oldNode.GetMasterAddress() == newNode.GetMasterAddress() {
+		return nil
+	}
+	return []*nodes.Node{oldNode, newNode}
+}
+
+// 按下标顺序加锁, 避免多个 key 同时加锁时死锁. 返回解锁函数
+func (this *rebalancer) lockKeys(keys []string) func() {
+	indexMap := make(map[int]bool, len(keys))
+	indexList := make([]int, 0, len(keys))
+	for _, key := range keys {
+		index := int(this.slice.hash([]byte(key)) % rebalanceLockNum)
+		if !indexMap[index] {
+			indexMap[index] = true
+			indexList = append(indexList, index)
+		}
+	}
+	sort.Ints(indexList)
+	for _, index := range indexList {
+		this.locks[index].Lock()
+	}
+	return func() {
+		for _, index := range indexList {
+			this.locks[index].Unlock()
+		}
+	}
+}
+
+// 将 key 从旧节点迁移到新节点, 需持有 key 的锁.
+// 旧节点上已不存在时不处理, 新节点上已存在时以新节点为准, 只删除旧节点上的 key
+func (this *rebalancer) moveKey(key string) error {
+	nodeList := this.owners(key)
+	if nodeList == nil {
+		return nil
+	}
+	src, dst := nodeList[0].GetMasterDb(), nodeList[1].GetMasterDb()
+	replies, err := src.ProcMultiCmdMsg([]*protocol.Msg{newCmdMsg("DUMP", key), newCmdMsg("PTTL", key)})
+	if err == nil {
+		err = replyError(replies...)
+	}
+	if err != nil {
+		return this.moveFailed(err)
+	}
+	ttl := replies[1].GetInt()
+	if protocol.IsNilMsg(replies[0]) || ttl == -2 {
+		return nil
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	data, _ := replies[0].GetValueBytes()
+	restore := protocol.NewArrayMsg([]*protocol.Msg{
+		protocol.NewBulkStringMsg([]byte("RESTORE")),
+		protocol.NewBulkStringMsg([]byte(key)),
+		protocol.NewBulkStringMsg([]byte(strconv.FormatInt(ttl, 10))),
+		protocol.NewBulkStringMsg(data),
+	})
+	reply, err := dst.ProcCmdMsg(restore)
+	if err == nil {
+		if err = replyError(reply); err != nil && strings.HasPrefix(err.Error(), "BUSYKEY") {
+			err = nil
+		}
+	}
+	if err == nil {
+		reply, err = src.ProcCmdMsg(newCmdMsg("DEL", key))
+		if err == nil {
+			err = replyError(reply)
+		}
+	}
+	if err != nil {
+		return this.moveFailed(err)
+	}
+	atomic.AddInt64(&this.moved, 1)
+	stat.Incr(this.statMoved, 1)
+	return nil
+}
+
+func (this *rebalancer) moveFailed(err error) error {
+	atomic.AddInt64(&this.failed, 1)
+	stat.Incr(this.statFailed, 1)
+	return err
+}
+
+// 迁移请求涉及的 key, 需持有 key 的锁
+func (this *rebalancer) moveKeys(keys []string) error {
+	for _, key := range keys {
+		if err := this.moveKey(key); err != nil {
+			return fmt.Errorf("rebalance key %s failed: %s", key, err)
+		}
+	}
+	return nil
+}
+
+func (this *rebalancer) proc(msg *protocol.Msg) (*protocol.Msg, error) {
+	cmd, keys := msgKeys(msg)
+	if len(keys) == 0 {
+		return this.slice.proc(msg)
+	}
+	if isFallbackRead(cmd, keys) {
+		reply, err := this.slice.proc(msg)
+		if err == nil && protocol.IsNilMsg(reply) {
+			if nodeList := this.owners(keys[0]); nodeList != nil {
+				reply, err = nodeList[0].RelayMsg(msg)
+				// 读新旧节点之间 key 可能已迁移, 旧节点未命中时再读一次新节点
+				if err == nil && protocol.IsNilMsg(reply) {
+					return this.slice.proc(msg)
+				}
+			}
+		}
+		return reply, err
+	}
+	unlock := this.lockKeys(keys)
+	defer unlock()
+	if err := this.moveKeys(keys); err != nil {
+		return nil, err
+	}
+	return this.slice.proc(msg)
+}
+
+func (this *rebalancer) procPipeline(msgList []*protocol.Msg) ([]*protocol.Msg, error) {
+	var (
+		keys     []string
+		readKeys = make(map[int]string)
+	)
+	for i, msg := range msgList {
+		cmd, msgKeys := msgKeys(msg)
+		if isFallbackRead(cmd, msgKeys) {
+			readKeys[i] = msgKeys[0]
+		} else {
+			keys = append(keys, msgKeys...)
+		}
+	}
+	unlock := this.lockKeys(keys)
+	defer unlock()
+	if err := this.moveKeys(keys); err != nil {
+		return nil, err
+	}
+	ackList, err := this.slice.procPipeline(msgList)
+	if err != nil {
+		return ackList, err
+	}
+	// 未命中的 GET 按旧节点分组后读旧节点, 旧节点也未命中时再读一次新节点
+	groups := make(map[*nodes.Node][]int)
+	for i, key := range readKeys {
+		if ackList[i] == nil || !protocol.IsNilMsg(ackList[i]) {
+			continue
+		}
+		if nodeList := this.owners(key); nodeList != nil {
+			groups[nodeList[0]] = append(groups[nodeList[0]], i)
+		}
+	}
+	var retryList []int
+	for node, indexList := range groups {
+		group := make([]*protocol.Msg, len(indexList))
+		for i, index := range indexList {
+			group[i] = msgList[index]
+		}
+		acks, err := node.RelayMultiMsg(group)
+		if err != nil || len(acks) != len(group) {
+			continue
+		}
+		for i, index := range indexList {
+			ackList[index] = acks[i]
+			if protocol.IsNilMsg(acks[i]) {
+				retryList = append(retryList, index)
+			}
+		}
+	}
+	if len(retryList) == 0 {
+		return ackList, nil
+	}
+	retry := make([]*protocol.Msg, len(retryList))
+	for i, index := range retryList {
+		retry[i] = msgList[index]
+	}
+	if acks, err := this.slice.procPipeline(retry); err == nil && len(acks) == len(retry) {
+		for i, index := range retryList {
+			if acks[i] != nil {
+				ackList[index] = acks[i]
+			}
+		}
+	}
+	return ackList, nil
+}
+
+// 只有 GET 能以 nil 响应判断新节点未命中, 可不加锁直接读并在未命中时读旧节点, 旧节点也未命中时再读一次新节点
+func isFallbackRead(cmd string, keys []string) bool {
+	return cmd == "GET" && len(keys) == 1
+}
+
+// 请求的命令名 (大写) 及涉及的 key
+func msgKeys(msg *protocol.Msg) (string, []string) {
+	args, err := msg.Args()
+	if err != nil || len(args) == 0 {
+		return "", nil
+	}
+	cmd := strings.ToUpper(args[0])
+	return cmd, filter.GetKeys(cmd, args)
+}
+
+func newCmdMsg(args ...string) *protocol.Msg {
+	return protocol.NewArrayMsgFormStrings(args)
+}
+
+func replyError(replies ...*protocol.Msg) error {
+	for _, reply := range replies {
+		if reply != nil && reply.IsError() {
+			msg, _ := reply.GetError()
+			return errors.New(msg)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,386 @@
+package slice
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ncache/backend/hashkit"
+	"ncache/config"
+	"ncache/protocol"
+	"ncache/utils"
+)
+
+// 模拟 redis 的一个 key, fields 为字符串的值或哈希的 field, value 列表
+type fakeValue struct {
+	hash   bool
+	fields []string
+	pttl   int64
+}
+
+// 模拟 redis, 支持迁移及测试用到的命令. DUMP 的数据为类型及值的简单编码
+type fakeRedis struct {
+	sync.Mutex
+	ln          net.Listener
+	data        map[string]*fakeValue
+	failRestore bool
+	// 处理 GET 前调用, 不持有锁
+	beforeGet func(key string)
+}
+
+func newFakeRedis() *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	utils.AssertMustNoError(err)
+	r := &fakeRedis{ln: ln, data: make(map[string]*fakeValue)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (this *fakeRedis) addr() string {
+	return this.ln.Addr().String()
+}
+
+func (this *fakeRedis) set(key string, value *fakeValue) {
+	this.Lock()
+	defer this.Unlock()
+	this.data[key] = value
+}
+
+func (this *fakeRedis) get(key string) *fakeValue {
+	this.Lock()
+	defer this.Unlock()
+	return this.data[key]
+}
+
+func (this *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	bw := bufio.NewWriter(conn)
+	for {
+		msg, err := protocol.NewMsgFromReader(br)
+		if err != nil {
+			return
+		}
+		args, _ := msg.Args()
+		this.Lock()
+		beforeGet := this.beforeGet
+		this.Unlock()
+		if beforeGet != nil && len(args) == 2 && strings.ToUpper(args[0]) == "GET" {
+			beforeGet(args[1])
+		}
+		if err = this.do(args).WriteMsgBuffered(bw); err != nil {
+			return
+		}
+		if br.Buffered() == 0 {
+			bw.Flush()
+		}
+	}
+}
+
+func (this *fakeRedis) do(args []string) *protocol.Msg {
+	this.Lock()
+	defer this.Unlock()
+	wrongType := protocol.NewErrorMsg("WRONGTYPE Operation against a key holding the wrong kind of value")
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return protocol.MsgPONG
+	case "GET":
+		v := this.data[args[1]]
+		if v == nil {
+			return protocol.NullBulkString
+		}
+		if v.hash {
+			return wrongType
+		}
+		return protocol.NewBulkStringMsg([]byte(v.fields[0]))
+	case "SET":
+		this.data[args[1]] = &fakeValue{fields: []string{args[2]}, pttl: -1}
+		return protocol.MsgOK
+	case "HGETALL":
+		v := this.data[args[1]]
+		if v == nil {
+			return protocol.NewArrayMsg(nil)
+		}
+		if !v.hash {
+			return wrongType
+		}
+		return protocol.NewArrayMsgFormStrings(v.fields)
+	case "EXISTS", "DEL":
+		var n int64
+		for _, key := range args[1:] {
+			if this.data[key] != nil {
+				n++
+				if strings.ToUpper(args[0]) == "DEL" {
+					delete(this.data, key)
+				}
+			}
+		}
+		return protocol.NewIntegerMsg(n)
+	case "TTL", "PTTL":
+		v := this.data[args[1]]
+		if v == nil {
+			return protocol.NewIntegerMsg(-2)
+		}
+		if v.pttl > 0 && strings.ToUpper(args[0]) == "TTL" {
+			return protocol.NewIntegerMsg(v.pttl / 1000)
+		}
+		return protocol.NewIntegerMsg(v.pttl)
+	case "DUMP":
+		v := this.data[args[1]]
+		if v == nil {
+			return protocol.NullBulkString
+		}
+		return protocol.NewBulkStringMsg([]byte(strconv.FormatBool(v.hash) + "\n" + strings.Join(v.fields, "\n")))
+	case "RESTORE":
+		if this.failRestore {
+			return protocol.NewErrorMsg("ERR DUMP payload version or checksum are wrong")
+		}
+		if this.data[args[1]] != nil {
+			return protocol.NewErrorMsg("BUSYKEY Target key name already exists.")
+		}
+		parts := strings.Split(args[3], "\n")
+		v := &fakeValue{fields: parts[1:], pttl: -1}
+		v.hash, _ = strconv.ParseBool(parts[0])
+		if ttl, _ := strconv.ParseInt(args[2], 10, 64); ttl > 0 {
+			v.pttl = ttl
+		}
+		this.data[args[1]] = v
+		return protocol.MsgOK
+	}
+	return protocol.NewErrorMsg("ERR unknown command '" + args[0] + "'")
+}
+
+func newTestSlice(addrs ...string) *Slice {
+	conf := config.SliceConf{
+		Hash:         "crc32a",
+		Distribution: "ketama",
+		Masters:      addrs,
+		InitConnNum:  2,
+		MaxConnNum:   4,
+		ConnTimeout:  1000,
+		ReadTimeout:  1000,
+		WriteTimeout: 1000,
+	}
+	for i := range addrs {
+		conf.Weights = append(conf.Weights, 1)
+		conf.NodeNames = append(conf.NodeNames, "node"+strconv.Itoa(i))
+	}
+	s, err := NewSlice(conf)
+	utils.AssertMustNoError(err)
+	return s
+}
+
+// 旧 slice 只有节点 old, 新 slice 增加节点 new, 返回挂在新 slice 上的 rebalancer
+func newTestRebalancer() (r *rebalancer, oldRedis, newRedis *fakeRedis) {
+	oldRedis, newRedis = newFakeRedis(), newFakeRedis()
+	s := newTestSlice(oldRedis.addr(), newRedis.addr())
+	r = &rebalancer{
+		slice:      s,
+		old:        newTestSlice(oldRedis.addr()),
+		closeChan:  make(chan struct{}),
+		statMoved:  "rebalance_test_moved",
+		statFailed: "rebalance_test_failed",
+	}
+	s.rebalance = r
+	return r, oldRedis, newRedis
+}
+
+// 归属从旧节点变为新节点的 n 个 key
+func movedKeys(r *rebalancer, n int) []string {
+	var keys []string
+	for i := 0; len(keys) < n; i++ {
+		key := "key:" + strconv.Itoa(i)
+		if r.owners(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestMoveKey(t *testing.T) {
+	r, oldRedis, newRedis := newTestRebalancer()
+	keys := movedKeys(r, 4)
+
+	// 迁移值及过期时间, 并删除旧节点上的 key
+	oldRedis.set(keys[0], &fakeValue{hash: true, fields: []string{"f", "v"}, pttl: 5000})
+	utils.AssertMustNoError(r.moveKey(keys[0]))
+	v := newRedis.get(keys[0])
+	utils.AssertMust(v != nil && v.hash && strings.Join(v.fields, ",") == "f,v" && v.pttl == 5000)
+	utils.AssertMust(oldRedis.get(keys[0]) == nil)
+	utils.AssertMust(r.moved == 1)
+
+	// 旧节点上不存在时不处理
+	utils.AssertMustNoError(r.moveKey(keys[1]))
+	utils.AssertMust(newRedis.get(keys[1]) == nil && r.moved == 1)
+
+	// 新节点上已存在 (BUSYKEY) 时保留新值, 删除旧值
+	oldRedis.set(keys[2], &fakeValue{fields: []string{"old"}, pttl: -1})
+	newRedis.set(keys[2], &fakeValue{fields: []string{"new"}, pttl: -1})
+	utils.AssertMustNoError(r.moveKey(keys[2]))
+	utils.AssertMust(newRedis.get(keys[2]).fields[0] == "new")
+	utils.AssertMust(oldRedis.get(keys[2]) == nil)
+
+	// RESTORE 失败时保留旧值并计数
+	newRedis.Lock()
+	newRedis.failRestore = true
+	newRedis.Unlock()
+	oldRedis.set(keys[3], &fakeValue{fields: []string{"old"}, pttl: -1})
+	utils.AssertMust(r.moveKey(keys[3]) != nil)
+	utils.AssertMust(oldRedis.get(keys[3]) != nil && newRedis.get(keys[3]) == nil)
+	utils.AssertMust(r.failed == 1)
+
+	// 归属未变化的 key 不处理
+	for i := 0; ; i++ {
+		key := "key:" + strconv.Itoa(i)
+		if r.owners(key) == nil {
+			oldRedis.set(key, &fakeValue{fields: []string{"v"}, pttl: -1})
+			utils.AssertMustNoError(r.moveKey(key))
+			utils.AssertMust(oldRedis.get(key) != nil)
+			break
+		}
+	}
+}
+
+// GET 未命中时读旧节点, 不迁移; 其他读请求先迁移再读新节点
+func TestRebalanceRead(t *testing.T) {
+	r, oldRedis, newRedis := newTestRebalancer()
+	keys := movedKeys(r, 4)
+	oldRedis.set(keys[0], &fakeValue{fields: []string{"v0"}, pttl: -1})
+	oldRedis.set(keys[1], &fakeValue{hash: true, fields: []string{"f", "v1"}, pttl: -1})
+	oldRedis.set(keys[2], &fakeValue{fields: []string{"v2"}, pttl: 8000})
+
+	reply, err := r.slice.Proc(newCmdMsg("GET", keys[0]))
+	utils.AssertMustNoError(err)
+	value, _ := reply.GetValueBytes()
+	utils.AssertMust(string(value) == "v0")
+	utils.AssertMust(oldRedis.get(keys[0]) != nil && newRedis.get(keys[0]) == nil)
+
+	reply, err = r.slice.Proc(newCmdMsg("HGETALL", keys[1]))
+	utils.AssertMustNoError(err)
+	utils.AssertMust(len(reply.GetArray()) == 2)
+	utils.AssertMust(oldRedis.get(keys[1]) == nil && newRedis.get(keys[1]) != nil)
+
+	reply, err = r.slice.Proc(newCmdMsg("TTL", keys[2]))
+	utils.AssertMustNoError(err)
+	utils.AssertMust(reply.GetInt() == 8)
+
+	// 管道中的 GET 及其他读请求
+	replies, err := r.slice.ProcPipeline([]*protocol.Msg{
+		newCmdMsg("GET", keys[0]),
+		newCmdMsg("EXISTS", keys[2]),
+		newCmdMsg("GET", keys[3]),
+		newCmdMsg("HGETALL", keys[1]),
+	})
+	utils.AssertMustNoError(err)
+	utils.AssertMust(len(replies) == 4)
+	value, _ = replies[0].GetValueBytes()
+	utils.AssertMust(string(value) == "v0")
+	utils.AssertMust(replies[1].GetInt() == 1)
+	utils.AssertMust(protocol.IsNilMsg(replies[2]))
+	utils.AssertMust(len(replies[3].GetArray()) == 2)
+}
+
+// 读新节点未命中后、读旧节点前 key 被迁移时, 再读一次新节点
+func TestRebalanceReadMoving(t *testing.T) {
+	r, oldRedis, newRedis := newTestRebalancer()
+	keys := movedKeys(r, 2)
+	oldRedis.set(keys[0], &fakeValue{fields: []string{"v0"}, pttl: -1})
+	oldRedis.set(keys[1], &fakeValue{fields: []string{"v1"}, pttl: -1})
+	oldRedis.Lock()
+	oldRedis.beforeGet = func(key string) {
+		if v := oldRedis.get(key); v != nil {
+			newRedis.set(key, v)
+			oldRedis.do([]string{"DEL", key})
+		}
+	}
+	oldRedis.Unlock()
+
+	reply, err := r.slice.Proc(newCmdMsg("GET", keys[0]))
+	utils.AssertMustNoError(err)
+	value, _ := reply.GetValueBytes()
+	utils.AssertMust(string(value) == "v0")
+
+	replies, err := r.slice.ProcPipeline([]*protocol.Msg{newCmdMsg("GET", keys[1])})
+	utils.AssertMustNoError(err)
+	value, _ = replies[0].GetValueBytes()
+	utils.AssertMust(string(value) == "v1")
+}
+
+// 写请求先迁移 key, 再写入新节点
+func TestRebalanceWrite(t *testing.T) {
+	r, oldRedis, newRedis := newTestRebalancer()
+	keys := movedKeys(r, 2)
+	oldRedis.set(keys[0], &fakeValue{fields: []string{"old"}, pttl: -1})
+	oldRedis.set(keys[1], &fakeValue{fields: []string{"old"}, pttl: -1})
+
+	reply, err := r.slice.Proc(newCmdMsg("SET", keys[0], "new"))
+	utils.AssertMustNoError(err)
+	utils.AssertMust(protocol.IsOkMsg(reply))
+	utils.AssertMust(oldRedis.get(keys[0]) == nil && newRedis.get(keys[0]).fields[0] == "new")
+
+	replies, err := r.slice.ProcPipeline([]*protocol.Msg{newCmdMsg("DEL", keys[1]), newCmdMsg("GET", keys[1])})
+	utils.AssertMustNoError(err)
+	utils.AssertMust(replies[0].GetInt() == 1 && protocol.IsNilMsg(replies[1]))
+	utils.AssertMust(oldRedis.get(keys[1]) == nil && newRedis.get(keys[1]) == nil)
+}
+
+func TestParseScanReply(t *testing.T) {
+	reply := protocol.NewArrayMsg([]*protocol.Msg{
+		protocol.NewBulkStringMsg([]byte("17")),
+		protocol.NewArrayMsgFormStrings([]string{"feed:1", "feed:2"}),
+	})
+	cursor, keys, err := parseScanReply(reply)
+	utils.AssertMustNoError(err)
+	utils.AssertMust(cursor == "17" && len(keys) == 2 && keys[0] == "feed:1" && keys[1] == "feed:2")
+	_, _, err = parseScanReply(protocol.NewErrorMsg("ERR unknown command"))
+	utils.AssertMust(err != nil)
+	_, _, err = parseScanReply(protocol.NewArrayMsgFormStrings([]string{"0"}))
+	utils.AssertMust(err != nil)
+}
+
+// 重复及落在同一把锁上的 key 只加锁一次, 解锁后可再次加锁
+func TestLockKeys(t *testing.T) {
+	r := &rebalancer{slice: &Slice{hash: hashkit.HashCrc32a}}
+	unlock := r.lockKeys([]string{"a", "b", "a"})
+	locked := make(chan struct{})
+	go func() {
+		r.lockKeys([]string{"b"})()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		utils.AssertMust(false)
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		utils.AssertMust(false)
+	}
+	r.lockKeys([]string{"a", "b"})()
+}
+
+func TestSameLayout(t *testing.T) {
+	s1 := &Slice{continuums: []hashkit.Continuum{{}}}
+	s2 := &Slice{continuums: []hashkit.Continuum{{}}}
+	utils.AssertMust(sameLayout(s1, s2))
+	s2.continuums = append(s2.continuums, hashkit.Continuum{})
+	utils.AssertMust(!sameLayout(s1, s2))
+
+	r, _, _ := newTestRebalancer()
+	utils.AssertMust(!sameLayout(r.slice, r.old))
+	utils.AssertMust(sameLayout(r.old, newTestSlice(r.old.nodes[0].GetMasterAddress())))
+}
@@ -35,6 +35,8 @@ type Slice struct {
 	dispatch   DispatchFunc
 	build      BuildFunc
 	continuums []hashkit.Continuum
+	// 在线重新分片, 未进行时为 nil
+	rebalance *rebalancer
 }
 
 func NewSlice(conf config.SliceConf) (slice *Slice, err error) {
@@ -88,6 +90,13 @@ func NewSlice(conf config.SliceConf) (slice *Slice, err error) {
 }
 
 func (c *Slice) Proc(msg *protocol.Msg) (ackMsg *protocol.Msg, err error) {
+	if r := c.getRebalancer(); r != nil {
+		return r.proc(msg)
+	}
+	return c.proc(msg)
+}
+
+func (c *Slice) proc(msg *protocol.Msg) (ackMsg *protocol.Msg, err error) {
 	// In mod Polling, connect to proxy, differential procedure handled by proxy
 	// All commands will be considered as single key command
 	if c.mode == Polling {
@@ -125,3 +134,13 @@ func (s *Slice) GetNodes() []*nodes.Node {
 func (s *Slice) GetConf() interface{} {
 	return s.conf
 }
+
+// 重新分片未完成时停止迁移, 并关闭旧 slice
+func (s *Slice) Close() {
+	if s.rebalance != nil {
+		s.rebalance.close()
+	}
+	for _, node := range s.nodes {
+		node.Close()
+	}
+}
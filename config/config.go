@@ -26,6 +26,8 @@ type Config struct {
 	log           *log.LogConf
 	beConfs       map[string]Conf
 	beConfsReload map[string]Conf
+	// 启动时指定的 server 配置文件, 重新加载时使用
+	serverConfPath string
 }
 
 func init() {
@@ -40,6 +42,11 @@ func init() {
 			MaxClient:        defaultMaxClient,
 			MaxClientIdle:    defaultMaxClientIdle,
 			TimeTaskInterval: defaultTimeTaskInterval,
+			MaxBulkLen:       defaultMaxBulkLen,
+			MaxMultiBulkLen:  defaultMaxMultiBulkLen,
+			MaxRequestSize:   defaultMaxRequestSize,
+			MaxNesting:       defaultMaxNesting,
+			ShutdownTimeout:  defaultShutdownTimeout,
 		},
 		log: &log.LogConf{
 			Module:       defaultModule,
@@ -90,6 +97,7 @@ func InitConfig() error {
 	}
 	// 解析配置文件并替换默认值
 	if conf != "" {
+		Cfg.serverConfPath = conf
 		var sFile ServerConf
 		var lFile log.LogConf
 		var dbPathFile string
@@ -120,11 +128,19 @@ func InitConfig() error {
 	fs.IntVar(&sFlag.ServerPort, "server-port", defaultServerPort, "port of server")
 	fs.IntVar(&sFlag.MonitorPort, "monitor-port", defaultMonitorPort, "port of web monitor")
 	fs.IntVar(&sFlag.MaxClient, "client-max-num", defaultMaxClient, "max client num")
+	fs.IntVar(&sFlag.MaxClientPerIp, "client-max-per-ip", 0, "max client num per ip, 0 for unlimited")
 	fs.IntVar(&sFlag.MaxClientIdle, "client-max-idle", defaultMaxClientIdle, "client max idle time in seconds")
 	fs.IntVar(&sFlag.TimeTaskInterval, "time-task-interval", defaultTimeTaskInterval,
 		"time task interval")
 	fs.BoolVar(&sFlag.PprofEnable, "pprof-enable", true, "pprof enable, default true")
 	fs.StringVar(&sFlag.PprofAddr, "pprof-addr", "localhost:6060", "pprof http addr")
+	fs.Int64Var(&sFlag.MaxBulkLen, "max-bulk-len", defaultMaxBulkLen, "max length of a bulk string")
+	fs.Int64Var(&sFlag.MaxMultiBulkLen, "max-multibulk-len", defaultMaxMultiBulkLen, "max element num of a multibulk")
+	fs.Int64Var(&sFlag.MaxRequestSize, "max-request-size", defaultMaxRequestSize, "max size of a request or reply in bytes")
+	fs.IntVar(&sFlag.MaxNesting, "max-nesting", defaultMaxNesting, "max nesting depth of a request or reply")
+	fs.IntVar(&sFlag.ShutdownTimeout, "shutdown-timeout", defaultShutdownTimeout, "max seconds to wait for in-flight requests on shutdown")
+	fs.IntVar(&sFlag.RequestTimeout, "request-timeout", 0, "max milliseconds to process a request, 0 for unlimited")
+	fs.IntVar(&sFlag.ClientStageTimeout, "client-stage-timeout", 0, "max seconds a client may stay in one process stage, 0 for unlimited")
 	// log
 	var lFlag log.LogConf
 	fs.StringVar(&lFlag.Module, "log-module", defaultModule, "log module name")
@@ -171,6 +187,8 @@ func InitConfig() error {
 
 func ReloadDbConf() error { return Cfg.reloadDbConf() }
 
+func GetDbConfPath() string { return Cfg.dbConfPath }
+
 func (cfg *Config) reloadDbConf() error {
 	if cfg == nil {
 		return errors.New("Conf is nil")
@@ -180,7 +198,7 @@ func (cfg *Config) reloadDbConf() error {
 	if err != nil {
 		return err
 	}
-	if fileInfo.ModTime() == cfg.fileInfo.ModTime() {
+	if cfg.fileInfo != nil && fileInfo.ModTime() == cfg.fileInfo.ModTime() {
 		return errNoNeedReload
 	}
 	if dbConfPath == "" {
@@ -216,6 +234,49 @@ func (cfg *Config) reloadDbConfSpecifiedFile(file string) error {
 	return nil
 }
 
+// 重新解析启动时指定的 server 配置文件, 未指定配置文件时返回当前配置.
+// 只有部分配置项 (如 ip_filter, route_rules) 支持重新加载
+func ReloadServerConf() (*ServerConf, error) { return Cfg.reloadServerConf() }
+
+func (cfg *Config) reloadServerConf() (*ServerConf, error) {
+	if cfg.serverConfPath == "" {
+		return cfg.getServerConf()
+	}
+	var (
+		sConf      ServerConf
+		lConf      log.LogConf
+		dbConfPath string
+	)
+	if err := parseServerConfFromFile(cfg.serverConfPath, &sConf, &lConf, &dbConfPath); err != nil {
+		return nil, err
+	}
+	return &sConf, nil
+}
+
+func IsNoNeedReload(err error) bool {
+	return err == errNoNeedReload
+}
+
+func GetReloadBackendConfs() map[string]Conf {
+	return Cfg.beConfsReload
+}
+
+// 重新加载的配置生效后调用
+func CommitReload() { Cfg.commitReload() }
+
+func (cfg *Config) commitReload() {
+	cfg.beConfs = cfg.beConfsReload
+	cfg.beConfsReload = make(map[string]Conf)
+}
+
+// 重新加载的配置未能生效, 下次重新加载时不再对比文件修改时间
+func ResetReload() { Cfg.resetReload() }
+
+func (cfg *Config) resetReload() {
+	cfg.beConfsReload = make(map[string]Conf)
+	cfg.fileInfo = nil
+}
+
 func GetServerConf() (*ServerConf, error) { return Cfg.getServerConf() }
 func (cfg *Config) getServerConf() (*ServerConf, error) {
 	if cfg.server == nil {
@@ -347,6 +408,8 @@ func (cfg *Config) mergeWithFlags(sConf ServerConf, lConf log.LogConf, path stri
 			cfg.server.MonitorPort = sConf.MonitorPort
 		case "client-max-num":
 			cfg.server.MaxClient = sConf.MaxClient
+		case "client-max-per-ip":
+			cfg.server.MaxClientPerIp = sConf.MaxClientPerIp
 		case "client-max-idle":
 			cfg.server.MaxClientIdle = sConf.MaxClientIdle
 		case "time-task-interval":
@@ -365,6 +428,20 @@ func (cfg *Config) mergeWithFlags(sConf ServerConf, lConf log.LogConf, path stri
 			cfg.server.PprofEnable = sConf.PprofEnable
 		case "pprof-addr":
 			cfg.server.PprofAddr = sConf.PprofAddr
+		case "max-bulk-len":
+			cfg.server.MaxBulkLen = sConf.MaxBulkLen
+		case "max-multibulk-len":
+			cfg.server.MaxMultiBulkLen = sConf.MaxMultiBulkLen
+		case "max-request-size":
+			cfg.server.MaxRequestSize = sConf.MaxRequestSize
+		case "max-nesting":
+			cfg.server.MaxNesting = sConf.MaxNesting
+		case "shutdown-timeout":
+			cfg.server.ShutdownTimeout = sConf.ShutdownTimeout
+		case "request-timeout":
+			cfg.server.RequestTimeout = sConf.RequestTimeout
+		case "client-stage-timeout":
+			cfg.server.ClientStageTimeout = sConf.ClientStageTimeout
 		default:
 			continue
 		}
@@ -59,8 +59,8 @@ func resetCfg() {
 			SuffixFormat: defaultSuffixFormat,
 			MaxLogCount:  defaultMaxLogCount,
 		},
-		beConfs:       make(map[string]*NodeConf),
-		beConfsReload: make(map[string]*NodeConf),
+		beConfs:       make(map[string]Conf),
+		beConfsReload: make(map[string]Conf),
 	}
 }
 
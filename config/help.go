@@ -19,9 +19,14 @@ var (
 	flagsLine = `
 	//todo fill flags message
 	`
-	version = "ncache version: 0.0.1"
+	versionNumber = "0.0.1"
+	version       = "ncache version: " + versionNumber
 )
 
+func GetVersion() string {
+	return versionNumber
+}
+
 func printUsage() {
 	fmt.Println(usageLine)
 }
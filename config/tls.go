@@ -0,0 +1,85 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+type TlsConf struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// 用于校验对端证书的 CA, 服务端配置时要求客户端提供证书
+	CaFile string `json:"ca_file"`
+	// 最低 TLS 版本, 如 1.2, 默认 1.2
+	MinVersion string `json:"min_version"`
+	// 以下只用于连接后端, ServerName 为空时使用后端地址中的主机名
+	ServerName string `json:"server_name"`
+	// 不校验后端证书, 只用于测试
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+}
+
+// 监听端使用的 TLS 配置
+func (conf *TlsConf) ServerConfig() (*tls.Config, error) {
+	tlsConfig, err := conf.baseConfig()
+	if err != nil {
+		return nil, err
+	}
+	if len(tlsConfig.Certificates) == 0 {
+		return nil, fmt.Errorf("tls: cert_file and key_file required")
+	}
+	if tlsConfig.RootCAs != nil {
+		tlsConfig.ClientCAs, tlsConfig.RootCAs = tlsConfig.RootCAs, nil
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// 连接后端使用的 TLS 配置, 配置了证书时向后端提供客户端证书
+func (conf *TlsConf) ClientConfig() (*tls.Config, error) {
+	tlsConfig, err := conf.baseConfig()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ServerName = conf.ServerName
+	tlsConfig.InsecureSkipVerify = conf.InsecureSkipVerify
+	return tlsConfig, nil
+}
+
+func (conf *TlsConf) baseConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if conf.MinVersion != "" {
+		version, ok := tlsVersions[conf.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("tls: unknown min_version %s", conf.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: load cert: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if conf.CaFile != "" {
+		pem, err := ioutil.ReadFile(conf.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: read ca: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls: no cert found in %s", conf.CaFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,23 @@
+package config
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"ncache/utils"
+)
+
+func TestTlsConf(t *testing.T) {
+	_, err := (&TlsConf{}).ServerConfig()
+	utils.AssertMust(err != nil)
+	_, err = (&TlsConf{MinVersion: "2.0"}).baseConfig()
+	utils.AssertMust(err != nil)
+	_, err = (&TlsConf{CaFile: "not_exists.pem"}).baseConfig()
+	utils.AssertMust(err != nil)
+	tlsConfig, err := (&TlsConf{MinVersion: "1.3"}).baseConfig()
+	utils.AssertMustNoError(err)
+	utils.AssertMust(tlsConfig.MinVersion == tls.VersionTLS13)
+	tlsConfig, err = (&TlsConf{ServerName: "redis.local", InsecureSkipVerify: true}).ClientConfig()
+	utils.AssertMustNoError(err)
+	utils.AssertMust(tlsConfig.ServerName == "redis.local" && tlsConfig.InsecureSkipVerify)
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/janic716/golib/log"
@@ -24,6 +25,12 @@ var (
 	defaultMaxClient        = 5000
 	defaultMaxClientIdle    = 300
 	defaultTimeTaskInterval = 60
+	defaultShutdownTimeout  = 30
+
+	defaultMaxBulkLen      int64 = 512 * 1024 * 1024
+	defaultMaxMultiBulkLen int64 = 1024 * 1024
+	defaultMaxRequestSize  int64 = 1024 * 1024 * 1024
+	defaultMaxNesting            = 32
 )
 
 var (
@@ -59,15 +66,45 @@ func (node *NodeConf) String() string {
 }
 
 type DbConf struct {
-	Role         string `json:"role"`
-	Addr         string `json:"addr"`
-	User         string `json:"user"`
-	Pass         string `json:"pass"`
-	InitConnNum  int    `json:"init_conn_num"`
-	MaxConnNum   int    `json:"max_conn_num"`
-	ConnTimeout  int    `json:"conn_timeout"`
-	ReadTimeout  int    `json:"read_timeout"`
-	WriteTimeout int    `json:"write_timeout"`
+	Role         string   `json:"role"`
+	Addr         string   `json:"addr"`
+	User         string   `json:"user"`
+	Pass         string   `json:"pass"`
+	Db           int      `json:"db"`
+	Tls          *TlsConf `json:"tls"`
+	InitConnNum  int      `json:"init_conn_num"`
+	MaxConnNum   int      `json:"max_conn_num"`
+	ConnTimeout  int      `json:"conn_timeout"`
+	ReadTimeout  int      `json:"read_timeout"`
+	WriteTimeout int      `json:"write_timeout"`
+	// 多路复用连接数, 大于 0 时每个连接同时承载多个请求, 不再使用连接池
+	MuxConnNum int `json:"mux_conn_num"`
+	// 集群从节点, 连接建立后发送 READONLY
+	ReadOnly bool `json:"-"`
+	// 所属 backend 的名称, 用于区分各 backend 的统计项
+	Backend string `json:"-"`
+	// 熔断及降级规则, 未配置时不熔断
+	Degrade *DegradeConf `json:"degrade"`
+}
+
+// 统计窗口内请求数达到 min_requests 后, 错误率或慢请求比例达到阈值时熔断,
+// 熔断期间读写请求分别按 read_action (fail/nil) 及 write_action (fail/ok) 降级.
+// nil 按 key 不存在返回对应类型的响应, ok 只用于成功时返回 OK 的写命令, 其余命令仍返回错误
+type DegradeConf struct {
+	// 统计窗口, 单位秒, 默认 10
+	Window      int `json:"window"`
+	MinRequests int `json:"min_requests"`
+	// 0~1, 为 0 时不按该项熔断
+	ErrorRate float64 `json:"error_rate"`
+	SlowRate  float64 `json:"slow_rate"`
+	// 慢请求阈值, 单位毫秒
+	SlowThreshold int `json:"slow_threshold"`
+	// 熔断后进入半开状态的时间, 单位秒, 默认 5
+	OpenTime int `json:"open_time"`
+	// 半开状态下的探测请求数, 全部成功后恢复, 默认 3
+	HalfOpenRequests int    `json:"half_open_requests"`
+	ReadAction       string `json:"read_action"`
+	WriteAction      string `json:"write_action"`
 }
 
 type ServerConf struct {
@@ -76,14 +113,153 @@ type ServerConf struct {
 	ServerPort       int    `json:"server_port"`
 	MonitorPort      int    `json:"monitor_port"`
 	MaxClient        int    `json:"max_client"`
+	MaxClientPerIp   int    `json:"max_client_per_ip"` // 单个 ip 的最大连接数, 0 为不限制
 	MaxClientIdle    int    `json:"max_client_idle"`
 	TimeTaskInterval int    `json:"time_task_interval"`
 	PprofEnable      bool   `json:"pprof_enable"`
 	PprofAddr        string `json:"pprof_addr"`
+	// 客户端请求的协议解析限制, 后端响应不限制
+	MaxBulkLen      int64 `json:"max_bulk_len"`
+	MaxMultiBulkLen int64 `json:"max_multibulk_len"`
+	MaxRequestSize  int64 `json:"max_request_size"`
+	MaxNesting      int   `json:"max_nesting"`
+	// 关闭服务时等待处理中请求完成的最长时间, 单位秒
+	ShutdownTimeout int `json:"shutdown_timeout"`
+	// 单个请求从路由到响应的最长处理时间, 单位毫秒, 0 为不限制
+	RequestTimeout int `json:"request_timeout"`
+	// 客户端停留在同一处理阶段的最长时间, 超过后由定时任务关闭, 单位秒, 0 为不限制
+	ClientStageTimeout int `json:"client_stage_timeout"`
+	// 启用的插件, 按配置顺序执行
+	Plugins []PluginConf `json:"plugins"`
+	// 代理的认证用户, 为空时不需要认证
+	Users []UserConf `json:"users"`
+	// 客户端连接使用 TLS, 未配置时不加密
+	Tls *TlsConf `json:"tls"`
+	// address:server_port 之外的监听地址
+	Listeners []ListenerConf `json:"listeners"`
+	// 所有监听地址的客户端黑白名单, 重新加载配置时生效
+	IpFilter *IpFilterConf `json:"ip_filter"`
+	// 按 backend 前缀限制请求中的 key
+	KeyRules []KeyRuleConf `json:"key_rules"`
+	// 按顺序匹配的路由规则, 没有匹配时使用 key 中 : 之前的前缀, 重新加载配置时生效
+	RouteRules []RouteRuleConf `json:"route_rules"`
+	// address:server_port 是否使用 PROXY 协议
+	ProxyProtocol bool `json:"proxy_protocol"`
+	// address:server_port 允许发送 PROXY 协议头的地址, 同 listeners 中的 proxy_trusted
+	ProxyTrusted []string `json:"proxy_trusted"`
+	// 是否允许执行代理的 NCACHE 管理命令, 默认关闭; 开启后配置了 acl 的用户还需 admin 权限
+	AdminEnable bool `json:"admin_enable"`
+}
+
+type ListenerConf struct {
+	// tcp 或 unix, 默认 tcp
+	Network string `json:"network"`
+	// tcp 为 ip:port, unix 为 socket 文件路径
+	Address string `json:"address"`
+	// unix socket 文件权限, 八进制, 如 0660
+	Mode string   `json:"mode"`
+	Tls  *TlsConf `json:"tls"`
+	// 不为空时所有请求转发到该 backend, 不再按 key 前缀路由
+	Backend string `json:"backend"`
+	// 允许执行的命令, 为空时不限制
+	Commands []string `json:"commands"`
+	// 在全局的 ip_filter 之外, 对该监听地址的连接再做限制
+	IpFilter *IpFilterConf `json:"ip_filter"`
+	// 位于 L4 负载均衡之后时开启, 连接建立时读取 PROXY 协议 v1/v2 头
+	ProxyProtocol bool `json:"proxy_protocol"`
+	// 允许发送 PROXY 协议头的负载均衡地址 (CIDR 或 ip), 开启 proxy_protocol 时必须配置.
+	// 其他地址的连接直接关闭, 避免伪造客户端地址绕过 ip_filter 及单 ip 连接数限制
+	ProxyTrusted []string `json:"proxy_trusted"`
+}
+
+// type 为 prefix, glob, regex, hashtag 或 command.
+// regex 规则的 backend 中可使用 $1 等引用分组, hashtag 规则的 backend 为空时使用 {} 中的内容
+type RouteRuleConf struct {
+	Type    string `json:"type"`
+	Pattern string `json:"pattern"`
+	Backend string `json:"backend"`
+	// command 规则匹配的命令
+	Commands []string `json:"commands"`
+}
+
+// 客户端地址的黑白名单, CIDR 或单个 ip, deny 优先; allow 为空时不限制
+type IpFilterConf struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+type UserConf struct {
+	Name string `json:"name"`
+	// 密码的 sha256 值, 十六进制, 为空时只能通过客户端证书认证
+	Pass string `json:"pass"`
+	// 客户端证书的 CN 与之相同时, 连接建立后自动认证为该用户
+	CertCn string `json:"cert_cn"`
+	// 访问权限, 未配置时不限制
+	Acl *AclConf `json:"acl"`
+}
+
+// 按 key 前缀 (路由使用的前缀) 控制读写权限, * 表示所有前缀
+type AclConf struct {
+	Read  []string `json:"read"`
+	Write []string `json:"write"`
+	Admin bool     `json:"admin"`
+}
+
+// 前缀为 * 时对没有单独配置规则的前缀生效, 不含 : 的 key 前缀为 default
+type KeyRuleConf struct {
+	Prefix string `json:"prefix"`
+	// key 的最大长度, 0 为不限制
+	MaxLen int `json:"max_len"`
+	// key 必须匹配的正则
+	Format string `json:"format"`
+	// 禁止的 key 模式, glob 语法与 redis KEYS 一致
+	ForbiddenGlob  []string `json:"forbidden_glob"`
+	ForbiddenRegex []string `json:"forbidden_regex"`
+	// 禁止访问的 key, 可通过 NCACHE BLOCKKEY 在运行时修改
+	Blocklist []string `json:"blocklist"`
+}
+
+type PluginConf struct {
+	Name string `json:"name"`
+	// 插件自定义的配置, 由插件自行解析
+	Conf json.RawMessage `json:"conf"`
 }
 
 type Conf interface {
 	GetType() string
+	GetCommands() []string
+	GetMirror() *MirrorConf
+	GetMigrate() *MigrateConf
+}
+
+// 将该 backend 的数据迁移到另一个 backend, phase 为 write_both, read_new 或 new_only
+type MigrateConf struct {
+	Backend string `json:"backend"`
+	Phase   string `json:"phase"`
+}
+
+// 节点或权重变化重新加载时, 将归属变化的 key 在后台迁移到新节点
+type RebalanceConf struct {
+	// 每次 SCAN 的 COUNT, 默认 100
+	ScanCount int `json:"scan_count"`
+	// 每秒最多迁移的 key 数, 默认 1000
+	MaxKeysPerSec int `json:"max_keys_per_sec"`
+}
+
+// 将部分请求异步复制到另一个 backend, 不影响原请求的处理
+type MirrorConf struct {
+	// 目标 backend 的名称
+	Backend string `json:"backend"`
+	// 复制的比例, 大于 0 且不超过 1
+	Rate float64 `json:"rate"`
+	// all, read 或 write, 默认 all
+	Mode string `json:"mode"`
+	// 是否对比两者的响应, 不一致时计数
+	Compare bool `json:"compare"`
+	// 等待复制的最大请求数, 超过后丢弃, 默认 1024
+	QueueSize int `json:"queue_size"`
+	// 复制请求的协程数, 默认 4
+	Workers int `json:"workers"`
 }
 
 type ClusterConf struct {
@@ -97,17 +273,41 @@ type ClusterConf struct {
 	// 节点地址以IP:PORT的形式输入，当节点有多个从节点时，应以','分割
 	Masters      []string `json:"masters"`
 	Slaves       []string `json:"slaves`
+	User         string   `json:"user"`
+	Pass         string   `json:"pass"`
+	Tls          *TlsConf `json:"tls"`
 	InitConnNum  int      `json:"init_conn_num"`
 	MaxConnNum   int      `json:"max_conn_num"`
+	MuxConnNum   int      `json:"mux_conn_num"`
 	ConnTimeout  int      `json:"conn_timeout"`
 	ReadTimeout  int      `json:"read_timeout"`
 	WriteTimeout int      `json:"write_timeout"`
+	// 允许执行的命令或命令类型 (@read, @write), 为空时不限制
+	Commands []string `json:"commands"`
+	// 每个节点的熔断及降级规则
+	Degrade *DegradeConf `json:"degrade"`
+	// 流量复制, 未配置时不复制
+	Mirror *MirrorConf `json:"mirror"`
+	// 迁移到另一个 backend, 未配置时不迁移
+	Migrate *MigrateConf `json:"migrate"`
 }
 
 func (c ClusterConf) GetType() string {
 	return c.Type
 }
 
+func (c ClusterConf) GetCommands() []string {
+	return c.Commands
+}
+
+func (c ClusterConf) GetMirror() *MirrorConf {
+	return c.Mirror
+}
+
+func (c ClusterConf) GetMigrate() *MigrateConf {
+	return c.Migrate
+}
+
 type SliceConf struct {
 	Name             string `json:"name"`
 	Mode             byte   `json:"mode"`
@@ -122,17 +322,44 @@ type SliceConf struct {
 	Slaves       []string `json:"slaves"`
 	Weights      []int    `json:"weights"`
 	NodeNames    []string `json:"node_name"`
+	User         string   `json:"user"`
+	Pass         string   `json:"pass"`
+	Db           int      `json:"db"`
+	Tls          *TlsConf `json:"tls"`
 	InitConnNum  int      `json:"init_conn_num"`
 	MaxConnNum   int      `json:"max_conn_num"`
+	MuxConnNum   int      `json:"mux_conn_num"`
 	ConnTimeout  int      `json:"conn_timeout"`
 	ReadTimeout  int      `json:"read_timeout"`
 	WriteTimeout int      `json:"write_timeout"`
+	// 允许执行的命令或命令类型 (@read, @write), 为空时不限制
+	Commands []string `json:"commands"`
+	// 每个节点的熔断及降级规则
+	Degrade *DegradeConf `json:"degrade"`
+	// 流量复制, 未配置时不复制
+	Mirror *MirrorConf `json:"mirror"`
+	// 迁移到另一个 backend, 未配置时不迁移
+	Migrate *MigrateConf `json:"migrate"`
+	// 在线重新分片, 未配置时节点变化后直接按新的分布读写
+	Rebalance *RebalanceConf `json:"rebalance"`
 }
 
 func (s SliceConf) GetType() string {
 	return s.Type
 }
 
+func (s SliceConf) GetCommands() []string {
+	return s.Commands
+}
+
+func (s SliceConf) GetMirror() *MirrorConf {
+	return s.Mirror
+}
+
+func (s SliceConf) GetMigrate() *MigrateConf {
+	return s.Migrate
+}
+
 func (s *SliceConf) GetWeights() []int {
 	return s.Weights
 }
@@ -154,8 +381,14 @@ func GetNodesConf(value interface{}) (nodes []NodeConf, err error) {
 		if len(conf.Masters) != len(conf.Weights) || len(conf.Masters) != len(conf.NodeNames) {
 			return nil, errors.New("Invlid Slice conf")
 		}
+		user := conf.User
+		pass := conf.Pass
+		db := conf.Db
+		tlsConf := conf.Tls
+		degrade := conf.Degrade
 		initConn := conf.InitConnNum
 		maxConn := conf.MaxConnNum
+		muxConn := conf.MuxConnNum
 		cout := conf.ConnTimeout
 		rout := conf.ReadTimeout
 		wout := conf.WriteTimeout
@@ -165,9 +398,10 @@ func GetNodesConf(value interface{}) (nodes []NodeConf, err error) {
 				Name:   conf.NodeNames[i],
 				Weight: conf.Weights[i],
 			}
-			master := dbConfHelpFunc(initConn, maxConn, cout, rout, wout)
+			master := dbConfHelpFunc(user, pass, db, tlsConf, degrade, initConn, maxConn, muxConn, cout, rout, wout)
 			master.Role = "master"
 			master.Addr = conf.Masters[i]
+			master.Backend = conf.Name
 			node.Master = &master
 			if len(conf.Slaves) == 0 || len(conf.Slaves[i]) == 0 {
 				nodes = append(nodes, node)
@@ -175,9 +409,10 @@ func GetNodesConf(value interface{}) (nodes []NodeConf, err error) {
 			}
 			slaveAddrs := strings.Split(conf.Slaves[i], ",")
 			for _, slaveAddr := range slaveAddrs {
-				slave := dbConfHelpFunc(initConn, maxConn, cout, rout, wout)
+				slave := dbConfHelpFunc(user, pass, db, tlsConf, degrade, initConn, maxConn, muxConn, cout, rout, wout)
 				slave.Role = "slave"
 				slave.Addr = slaveAddr
+				slave.Backend = conf.Name
 				node.Slaves = append(node.Slaves, &slave)
 			}
 			nodes = append(nodes, node)
@@ -190,16 +425,24 @@ func GetNodesConf(value interface{}) (nodes []NodeConf, err error) {
 			return nil, errors.New("The length of the master and slave nodes does not match")
 		}
 		mode := conf.Mode
+		user := conf.User
+		pass := conf.Pass
+		// redis 集群只支持 0 号 db
+		db := 0
+		tlsConf := conf.Tls
+		degrade := conf.Degrade
 		initConn := conf.InitConnNum
 		maxConn := conf.MaxConnNum
+		muxConn := conf.MuxConnNum
 		cout := conf.ConnTimeout
 		rout := conf.ReadTimeout
 		wout := conf.WriteTimeout
 		for i := 0; i < len(conf.Masters); i++ {
 			node := NodeConf{Mode: mode}
-			master := dbConfHelpFunc(initConn, maxConn, cout, rout, wout)
+			master := dbConfHelpFunc(user, pass, db, tlsConf, degrade, initConn, maxConn, muxConn, cout, rout, wout)
 			master.Role = "master"
 			master.Addr = conf.Masters[i]
+			master.Backend = conf.Name
 			node.Master = &master
 			if len(conf.Slaves) == 0 || len(conf.Slaves[i]) == 0 {
 				nodes = append(nodes, node)
@@ -207,9 +450,11 @@ func GetNodesConf(value interface{}) (nodes []NodeConf, err error) {
 			}
 			slaveAddrs := strings.Split(conf.Slaves[i], ",")
 			for _, slaveAddr := range slaveAddrs {
-				slave := dbConfHelpFunc(initConn, maxConn, cout, rout, wout)
+				slave := dbConfHelpFunc(user, pass, db, tlsConf, degrade, initConn, maxConn, muxConn, cout, rout, wout)
 				slave.Role = "slave"
 				slave.Addr = slaveAddr
+				slave.Backend = conf.Name
+				slave.ReadOnly = true
 				node.Slaves = append(node.Slaves, &slave)
 			}
 			nodes = append(nodes, node)
@@ -219,8 +464,20 @@ func GetNodesConf(value interface{}) (nodes []NodeConf, err error) {
 	return nodes, nil
 }
 
-func dbConfHelpFunc(initConn, maxConn, cout, rout, wout int) DbConf {
-	return DbConf{"", "", "", "", initConn, maxConn, cout, rout, wout}
+func dbConfHelpFunc(user, pass string, db int, tlsConf *TlsConf, degrade *DegradeConf, initConn, maxConn, muxConn, cout, rout, wout int) DbConf {
+	return DbConf{
+		User:         user,
+		Pass:         pass,
+		Db:           db,
+		Tls:          tlsConf,
+		Degrade:      degrade,
+		InitConnNum:  initConn,
+		MaxConnNum:   maxConn,
+		MuxConnNum:   muxConn,
+		ConnTimeout:  cout,
+		ReadTimeout:  rout,
+		WriteTimeout: wout,
+	}
 }
 
 // todo check and adjust return false when serious problem, else check and adjust then return true
@@ -252,12 +509,66 @@ func mergeServerConf(conf1, conf2 *ServerConf) (err error) {
 	if conf2.MaxClient != 0 {
 		conf1.MaxClient = conf2.MaxClient
 	}
+	if conf2.MaxClientPerIp != 0 {
+		conf1.MaxClientPerIp = conf2.MaxClientPerIp
+	}
 	if conf2.MaxClientIdle != 0 {
 		conf1.MaxClientIdle = conf2.MaxClientIdle
 	}
 	if conf2.TimeTaskInterval != 0 {
 		conf1.TimeTaskInterval = conf2.TimeTaskInterval
 	}
+	if conf2.MaxBulkLen != 0 {
+		conf1.MaxBulkLen = conf2.MaxBulkLen
+	}
+	if conf2.MaxMultiBulkLen != 0 {
+		conf1.MaxMultiBulkLen = conf2.MaxMultiBulkLen
+	}
+	if conf2.MaxRequestSize != 0 {
+		conf1.MaxRequestSize = conf2.MaxRequestSize
+	}
+	if conf2.MaxNesting != 0 {
+		conf1.MaxNesting = conf2.MaxNesting
+	}
+	if conf2.ShutdownTimeout != 0 {
+		conf1.ShutdownTimeout = conf2.ShutdownTimeout
+	}
+	if conf2.RequestTimeout != 0 {
+		conf1.RequestTimeout = conf2.RequestTimeout
+	}
+	if conf2.ClientStageTimeout != 0 {
+		conf1.ClientStageTimeout = conf2.ClientStageTimeout
+	}
+	if conf2.Plugins != nil {
+		conf1.Plugins = conf2.Plugins
+	}
+	if conf2.Users != nil {
+		conf1.Users = conf2.Users
+	}
+	if conf2.Tls != nil {
+		conf1.Tls = conf2.Tls
+	}
+	if conf2.Listeners != nil {
+		conf1.Listeners = conf2.Listeners
+	}
+	if conf2.ProxyProtocol {
+		conf1.ProxyProtocol = conf2.ProxyProtocol
+	}
+	if conf2.ProxyTrusted != nil {
+		conf1.ProxyTrusted = conf2.ProxyTrusted
+	}
+	if conf2.AdminEnable {
+		conf1.AdminEnable = conf2.AdminEnable
+	}
+	if conf2.IpFilter != nil {
+		conf1.IpFilter = conf2.IpFilter
+	}
+	if conf2.KeyRules != nil {
+		conf1.KeyRules = conf2.KeyRules
+	}
+	if conf2.RouteRules != nil {
+		conf1.RouteRules = conf2.RouteRules
+	}
 	return nil
 }
 
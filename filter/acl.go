@@ -0,0 +1,68 @@
+package filter
+
+const aclAll = "*"
+
+// 用户的访问权限, 按命令类型及 key 前缀控制.
+// 读命令需要 key 前缀的读权限, 写命令需要写权限, 管理命令需要 admin 权限, 本地命令不限制
+type Acl struct {
+	read     map[string]bool
+	write    map[string]bool
+	readAll  bool
+	writeAll bool
+	admin    bool
+}
+
+// 前缀为 * 时允许访问所有 key
+func NewAcl(read, write []string, admin bool) *Acl {
+	acl := &Acl{
+		read:  make(map[string]bool, len(read)),
+		write: make(map[string]bool, len(write)),
+		admin: admin,
+	}
+	for _, prefix := range read {
+		if prefix == aclAll {
+			acl.readAll = true
+		}
+		acl.read[prefix] = true
+	}
+	for _, prefix := range write {
+		if prefix == aclAll {
+			acl.writeAll = true
+		}
+		acl.write[prefix] = true
+	}
+	return acl
+}
+
+// 检查是否可以执行命令, 及访问命令涉及的每个 key, prefixFunc 返回 key 的前缀.
+// cmdOk 为 false 时无权执行该命令, keyOk 为 false 时无权访问其中的 key
+func (this *Acl) Check(cmd string, args []string, prefixFunc func(string) string) (cmdOk, keyOk bool) {
+	var (
+		prefixes map[string]bool
+		all      bool
+	)
+	switch cmdMap[cmd] {
+	case C_LOCAL:
+		return true, true
+	case C_ADMIN:
+		return this.admin, true
+	case C_READ:
+		prefixes, all = this.read, this.readAll
+	case C_WRITE:
+		prefixes, all = this.write, this.writeAll
+	default:
+		return false, true
+	}
+	if len(prefixes) == 0 {
+		return false, true
+	}
+	if all {
+		return true, true
+	}
+	for _, key := range GetKeys(cmd, args) {
+		if !prefixes[prefixFunc(key)] {
+			return true, false
+		}
+	}
+	return true, true
+}
@@ -0,0 +1,44 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"ncache/utils"
+)
+
+func testPrefix(key string) string {
+	return key[:strings.Index(key, ":")]
+}
+
+func TestGetKeys(t *testing.T) {
+	keys := GetKeys("MSET", []string{"MSET", "a", "1", "b", "2"})
+	utils.AssertMust(len(keys) == 2 && keys[0] == "a" && keys[1] == "b")
+	keys = GetKeys("DEL", []string{"DEL", "a", "b", "c"})
+	utils.AssertMust(len(keys) == 3 && keys[2] == "c")
+	keys = GetKeys("HSET", []string{"HSET", "a", "f", "v"})
+	utils.AssertMust(len(keys) == 1 && keys[0] == "a")
+	utils.AssertMust(GetKeys("PING", []string{"PING", "a"}) == nil)
+}
+
+func TestAclCheck(t *testing.T) {
+	acl := NewAcl([]string{"feed", "user"}, []string{"feed"}, false)
+	cmdOk, keyOk := acl.Check("GET", []string{"GET", "user:1"}, testPrefix)
+	utils.AssertMust(cmdOk && keyOk)
+	cmdOk, keyOk = acl.Check("SET", []string{"SET", "user:1", "v"}, testPrefix)
+	utils.AssertMust(cmdOk && !keyOk)
+	cmdOk, keyOk = acl.Check("MSET", []string{"MSET", "feed:1", "v", "user:1", "v"}, testPrefix)
+	utils.AssertMust(cmdOk && !keyOk)
+	cmdOk, _ = acl.Check("NCACHE", []string{"NCACHE", "STATS"}, testPrefix)
+	utils.AssertMust(!cmdOk)
+	cmdOk, _ = acl.Check("PING", []string{"PING"}, testPrefix)
+	utils.AssertMust(cmdOk)
+
+	acl = NewAcl([]string{"*"}, nil, true)
+	cmdOk, keyOk = acl.Check("GET", []string{"GET", "any:1"}, testPrefix)
+	utils.AssertMust(cmdOk && keyOk)
+	cmdOk, _ = acl.Check("SET", []string{"SET", "any:1", "v"}, testPrefix)
+	utils.AssertMust(!cmdOk)
+	cmdOk, _ = acl.Check("NCACHE", []string{"NCACHE", "STATS"}, testPrefix)
+	utils.AssertMust(cmdOk)
+}
@@ -3,6 +3,7 @@ package filter
 //todo: 根据命令过滤
 import (
 	"errors"
+	"fmt"
 	"ncache/protocol"
 	"strings"
 )
@@ -19,6 +20,9 @@ var cmdMap = make(map[string]int)
 
 func init() {
 	cmdMap["PING"] = C_LOCAL
+	cmdMap["HELLO"] = C_LOCAL
+	cmdMap["AUTH"] = C_LOCAL
+	cmdMap["NCACHE"] = C_ADMIN
 
 	cmdMap["CLUSTER"] = C_WRITE
 
@@ -136,6 +140,15 @@ func IsAdminCmd(cmd string) bool {
 	return checkCmd(cmd, C_ADMIN)
 }
 
+// 由代理自身处理的管理命令, 受 admin_enable 控制. 其余管理命令 (如 ROUTER) 仍按 key 转发到后端
+func IsProxyAdminCmd(cmd string) bool {
+	return cmd == "NCACHE"
+}
+
+func IsLocalCmd(cmd string) bool {
+	return checkCmd(cmd, C_LOCAL)
+}
+
 func checkCmd(cmd string, cmdType int) bool {
 	t, ok := cmdMap[strings.ToUpper(cmd)]
 	return ok && t == cmdType
@@ -166,3 +179,44 @@ func IsWriteCmdMsg(msg *protocol.Msg) bool {
 func IsReadCmdMsg(msg *protocol.Msg) bool {
 	return checkCmdMsg(msg, C_READ)
 }
+
+// backend 允许执行的命令, @read 及 @write 表示对应类型的所有命令
+type CmdAllowlist struct {
+	cmds  map[string]bool
+	read  bool
+	write bool
+}
+
+func NewCmdAllowlist(cmds []string) (*CmdAllowlist, error) {
+	list := &CmdAllowlist{cmds: make(map[string]bool, len(cmds))}
+	for _, cmd := range cmds {
+		switch cmd = strings.ToUpper(cmd); cmd {
+		case "@READ":
+			list.read = true
+		case "@WRITE":
+			list.write = true
+		default:
+			if !IsValidCmd(cmd) {
+				return nil, fmt.Errorf("Filter: unknown command %s", cmd)
+			}
+			list.cmds[cmd] = true
+		}
+	}
+	return list, nil
+}
+
+// list 为 nil 时不限制, 本地及管理命令不转发到 backend, 不受限制
+func (this *CmdAllowlist) Allow(cmd string) bool {
+	if this == nil || this.cmds[cmd] {
+		return true
+	}
+	switch cmdMap[cmd] {
+	case C_LOCAL, C_ADMIN:
+		return true
+	case C_READ:
+		return this.read
+	case C_WRITE:
+		return this.write
+	}
+	return false
+}
@@ -0,0 +1,23 @@
+package filter
+
+import (
+	"testing"
+
+	"ncache/utils"
+)
+
+func TestCmdAllowlist(t *testing.T) {
+	list, err := NewCmdAllowlist([]string{"get", "SET", "setex", "del", "expire"})
+	utils.AssertMustNoError(err)
+	utils.AssertMust(list.Allow("GET") && list.Allow("SETEX") && list.Allow("PING") && list.Allow("NCACHE"))
+	utils.AssertMust(!list.Allow("HGETALL") && !list.Allow("INCR") && !list.Allow("UNKNOWN"))
+
+	list, err = NewCmdAllowlist([]string{"@read", "del"})
+	utils.AssertMustNoError(err)
+	utils.AssertMust(list.Allow("HGETALL") && list.Allow("DEL") && !list.Allow("SET"))
+
+	var nilList *CmdAllowlist
+	utils.AssertMust(nilList.Allow("HGETALL"))
+	_, err = NewCmdAllowlist([]string{"@admin"})
+	utils.AssertMust(err != nil)
+}
@@ -1 +1,74 @@
 package filter
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// 按 CIDR 限制客户端地址, deny 优先; allow 不为空时只允许其中的地址
+type IpFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// 地址可以是 CIDR 或单个 ip, 如 10.0.0.0/8, 192.168.1.1, ::1
+func NewIpFilter(allow, deny []string) (*IpFilter, error) {
+	var err error
+	filter := &IpFilter{}
+	if filter.allow, err = parseIpNets(allow); err != nil {
+		return nil, err
+	}
+	if filter.deny, err = parseIpNets(deny); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func parseIpNets(list []string) ([]*net.IPNet, error) {
+	ipNets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Filter: invalid ip %s", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			ipNets = append(ipNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Filter: invalid cidr %s", s)
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+// filter 为 nil 时不限制; 无法解析的地址 (如 unix socket) 只受 allow 限制
+func (this *IpFilter) Allow(addr string) bool {
+	if this == nil {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	if ip != nil && containsIp(this.deny, ip) {
+		return false
+	}
+	if len(this.allow) == 0 {
+		return true
+	}
+	return ip != nil && containsIp(this.allow, ip)
+}
+
+func containsIp(ipNets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range ipNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,25 @@
+package filter
+
+import (
+	"testing"
+
+	"ncache/utils"
+)
+
+func TestIpFilter(t *testing.T) {
+	filter, err := NewIpFilter([]string{"10.0.0.0/8", "192.168.1.1", "::1"}, []string{"10.1.0.0/16"})
+	utils.AssertMustNoError(err)
+	utils.AssertMust(filter.Allow("10.0.0.1") && filter.Allow("192.168.1.1") && filter.Allow("::1"))
+	utils.AssertMust(!filter.Allow("10.1.2.3") && !filter.Allow("192.168.1.2") && !filter.Allow("/tmp/ncache.sock"))
+
+	filter, err = NewIpFilter(nil, []string{"10.1.0.0/16"})
+	utils.AssertMustNoError(err)
+	utils.AssertMust(filter.Allow("10.0.0.1") && !filter.Allow("10.1.0.1") && filter.Allow("/tmp/ncache.sock"))
+
+	var nilFilter *IpFilter
+	utils.AssertMust(nilFilter.Allow("10.1.0.1"))
+	_, err = NewIpFilter([]string{"10.0.0.0/33"}, nil)
+	utils.AssertMust(err != nil)
+	_, err = NewIpFilter(nil, []string{"localhost"})
+	utils.AssertMust(err != nil)
+}
@@ -1 +1,228 @@
 package filter
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 多 key 命令中 key 的位置, last 为负数时从末尾计算, step 为相邻 key 的间隔
+type keySpec struct {
+	first int
+	last  int
+	step  int
+}
+
+var multiKeyCmds = map[string]keySpec{
+	"MGET":   {1, -1, 1},
+	"DEL":    {1, -1, 1},
+	"EXISTS": {1, -1, 1},
+	"MSET":   {1, -1, 2},
+	"MSETNX": {1, -1, 2},
+}
+
+// 请求涉及的所有 key, 本地及管理命令不涉及 key.
+// 其余命令的第一个参数为 key
+func GetKeys(cmd string, args []string) []string {
+	if IsLocalCmd(cmd) || IsAdminCmd(cmd) || len(args) < 2 {
+		return nil
+	}
+	spec, ok := multiKeyCmds[cmd]
+	if !ok {
+		return args[1:2]
+	}
+	last := spec.last
+	if last < 0 {
+		last += len(args)
+	}
+	keys := make([]string, 0, (last-spec.first)/spec.step+1)
+	for i := spec.first; i <= last; i += spec.step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+const keyRuleAll = "*"
+
+// 单个 backend 前缀的 key 规则
+type KeyRule struct {
+	// 为 nil 时不检查格式
+	format    *regexp.Regexp
+	forbidden []*regexp.Regexp
+	// 禁止模式的原始配置, 用于错误信息
+	patterns []string
+	maxLen   int
+}
+
+// format 为 key 必须匹配的正则, globs 及 regexes 为禁止的 key 模式, glob 语法与 redis KEYS 一致
+func NewKeyRule(maxLen int, format string, globs, regexes []string) (*KeyRule, error) {
+	rule := &KeyRule{maxLen: maxLen}
+	var err error
+	if format != "" {
+		if rule.format, err = regexp.Compile(format); err != nil {
+			return nil, fmt.Errorf("Filter: invalid key format %s: %s", format, err)
+		}
+	}
+	for _, glob := range globs {
+		re, err := CompileGlob(glob)
+		if err != nil {
+			return nil, fmt.Errorf("Filter: invalid key glob %s: %s", glob, err)
+		}
+		rule.forbidden = append(rule.forbidden, re)
+		rule.patterns = append(rule.patterns, glob)
+	}
+	for _, expr := range regexes {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("Filter: invalid key regex %s: %s", expr, err)
+		}
+		rule.forbidden = append(rule.forbidden, re)
+		rule.patterns = append(rule.patterns, expr)
+	}
+	return rule, nil
+}
+
+// glob 语法与 redis KEYS 一致, 需完整匹配
+func CompileGlob(glob string) (*regexp.Regexp, error) {
+	return regexp.Compile(globToRegexp(glob))
+}
+
+// 将 glob 转为完整匹配的正则, 支持 * ? [...] 及 \ 转义
+func globToRegexp(glob string) string {
+	var buf strings.Builder
+	buf.WriteString(`^`)
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			buf.WriteString(`.*`)
+		case '?':
+			buf.WriteString(`.`)
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == -1 {
+				buf.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "^") {
+				class = "^" + strings.ReplaceAll(class[1:], `\`, `\\`)
+			} else {
+				class = strings.ReplaceAll(class, `\`, `\\`)
+			}
+			buf.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			buf.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteString(`$`)
+	return buf.String()
+}
+
+func (this *KeyRule) Check(key string) error {
+	if this.maxLen > 0 && len(key) > this.maxLen {
+		return fmt.Errorf("key too long, max length is %d", this.maxLen)
+	}
+	if this.format != nil && !this.format.MatchString(key) {
+		return fmt.Errorf("key '%s' does not match the required format", key)
+	}
+	for i, re := range this.forbidden {
+		if re.MatchString(key) {
+			return fmt.Errorf("key '%s' matches forbidden pattern '%s'", key, this.patterns[i])
+		}
+	}
+	return nil
+}
+
+// 按 backend 前缀检查 key, 并维护可在运行时修改的 key 黑名单.
+// 前缀为 * 的规则对没有单独配置规则的前缀生效
+type KeyPolicy struct {
+	rules   map[string]*KeyRule
+	mutex   sync.RWMutex
+	blocked map[string]bool
+}
+
+func NewKeyPolicy() *KeyPolicy {
+	return &KeyPolicy{
+		rules:   make(map[string]*KeyRule),
+		blocked: make(map[string]bool),
+	}
+}
+
+// 只在初始化时调用, 前缀不区分大小写
+func (this *KeyPolicy) AddRule(prefix string, rule *KeyRule) {
+	this.rules[strings.ToLower(prefix)] = rule
+}
+
+// prefixFunc 返回 key 的前缀
+func (this *KeyPolicy) Check(keys []string, prefixFunc func(string) string) error {
+	for _, key := range keys {
+		if this.IsBlocked(key) {
+			return fmt.Errorf("key '%s' is blocked", key)
+		}
+		rule, ok := this.rules[prefixFunc(key)]
+		if !ok {
+			rule, ok = this.rules[keyRuleAll]
+		}
+		if !ok {
+			continue
+		}
+		if err := rule.Check(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *KeyPolicy) IsBlocked(key string) bool {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.blocked[key]
+}
+
+// 返回新加入黑名单的 key 数
+func (this *KeyPolicy) Block(keys ...string) int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	n := 0
+	for _, key := range keys {
+		if !this.blocked[key] {
+			this.blocked[key] = true
+			n++
+		}
+	}
+	return n
+}
+
+// 返回从黑名单中移除的 key 数
+func (this *KeyPolicy) Unblock(keys ...string) int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	n := 0
+	for _, key := range keys {
+		if this.blocked[key] {
+			delete(this.blocked, key)
+			n++
+		}
+	}
+	return n
+}
+
+// 按字典序返回黑名单中的所有 key
+func (this *KeyPolicy) BlockedKeys() []string {
+	this.mutex.RLock()
+	keys := make([]string, 0, len(this.blocked))
+	for key := range this.blocked {
+		keys = append(keys, key)
+	}
+	this.mutex.RUnlock()
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,50 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"ncache/utils"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	rule, err := NewKeyRule(0, "", []string{"tmp:*", "h?llo", "id:[0-9]", "id:[^a-c]x", `a\*b`}, nil)
+	utils.AssertMustNoError(err)
+	for _, key := range []string{"tmp:", "tmp:1", "hello", "hallo", "id:5", "id:dx", "a*b"} {
+		utils.AssertMust(rule.Check(key) != nil)
+	}
+	for _, key := range []string{"tmpx", "heello", "id:x", "id:ax", "aab", "xtmp:1"} {
+		utils.AssertMust(rule.Check(key) == nil)
+	}
+}
+
+func TestKeyPolicy(t *testing.T) {
+	policy := NewKeyPolicy()
+	rule, err := NewKeyRule(10, `^feed:\d+$`, nil, []string{`:0+$`})
+	utils.AssertMustNoError(err)
+	policy.AddRule("FEED", rule)
+	rule, err = NewKeyRule(0, "", []string{"*secret*"}, nil)
+	utils.AssertMustNoError(err)
+	policy.AddRule("*", rule)
+
+	utils.AssertMustNoError(policy.Check([]string{"feed:1", "user:1"}, testPrefix))
+	err = policy.Check([]string{"feed:123456789"}, testPrefix)
+	utils.AssertMust(err != nil && strings.Contains(err.Error(), "too long"))
+	err = policy.Check([]string{"feed:abc"}, testPrefix)
+	utils.AssertMust(err != nil && strings.Contains(err.Error(), "format"))
+	err = policy.Check([]string{"feed:000"}, testPrefix)
+	utils.AssertMust(err != nil && strings.Contains(err.Error(), "forbidden"))
+	// user 没有单独的规则, 使用 * 的规则
+	utils.AssertMust(policy.Check([]string{"user:secret"}, testPrefix) != nil)
+
+	utils.AssertMust(policy.Block("user:1", "user:2", "user:1") == 2)
+	err = policy.Check([]string{"feed:1", "user:2"}, testPrefix)
+	utils.AssertMust(err != nil && strings.Contains(err.Error(), "blocked"))
+	keys := policy.BlockedKeys()
+	utils.AssertMust(len(keys) == 2 && keys[0] == "user:1")
+	utils.AssertMust(policy.Unblock("user:2", "user:3") == 1)
+	utils.AssertMustNoError(policy.Check([]string{"user:2"}, testPrefix))
+
+	_, err = NewKeyRule(0, "(", nil, nil)
+	utils.AssertMust(err != nil)
+}
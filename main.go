@@ -5,6 +5,9 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/janic716/golib/log"
 	"ncache/backend/route"
@@ -48,9 +51,44 @@ func initServer() (*Server, error) {
 	return server, nil
 }
 
-//todo:
-func initSignal() {
-
+// 收到 SIGHUP 后重新加载 backend 配置.
+// 收到 SIGINT/SIGTERM 后优雅关闭, 返回的 chan 用于获取退出码, 未在超时前完成清理时退出码为 1
+func initSignal(server *Server) <-chan int {
+	exitCode := make(chan int, 1)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			log.Infof("receive signal SIGHUP, reload backend conf")
+			if err := server.Reload(""); err != nil {
+				log.Errorf("reload backend conf err: %s", err)
+			}
+		}
+	}()
+	go func() {
+		sig := <-sigChan
+		log.Infof("receive signal %s, shutting down", sig)
+		// 再次收到信号时立即退出
+		go func() {
+			sig := <-sigChan
+			log.Warningf("receive signal %s again, exit now", sig)
+			os.Exit(1)
+		}()
+		var timeout time.Duration
+		if conf, err := config.GetServerConf(); err == nil {
+			timeout = time.Duration(conf.ShutdownTimeout) * time.Second
+		}
+		drained := server.Shutdown(timeout)
+		route.CloseBackends()
+		if drained {
+			exitCode <- 0
+		} else {
+			exitCode <- 1
+		}
+	}()
+	return exitCode
 }
 
 func initDebug() {
@@ -72,7 +110,6 @@ func main() {
 	initConf()
 	initLog()
 	initBackend()
-	initSignal()
 	initDebug()
 
 	server, err := initServer()
@@ -84,5 +121,7 @@ func main() {
 	// todo 测试用  之后删除
 	var exit chan bool
 	go common.StartProfile(exit)
+	exitCode := initSignal(server)
 	server.Run()
+	os.Exit(<-exitCode)
 }
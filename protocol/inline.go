@@ -0,0 +1,160 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+)
+
+// 与 redis 保持一致, inline 命令及协议中单行的最大长度
+const maxInlineSize = 64 * 1024
+
+var (
+	ErrorInlineTooLong    = errors.New("Protocol: too big inline request")
+	ErrorUnbalancedQuotes = errors.New("Protocol: unbalanced quotes in request")
+)
+
+// 读取一行 inline 命令并转换为 bulk string 数组, 空行直接跳过
+func readInline(br *msgReader) (*Msg, error) {
+	for {
+		line, err := readInlineLine(br)
+		if err != nil {
+			return nil, err
+		}
+		args, err := splitInlineArgs(line)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 0 {
+			continue
+		}
+		msg := getMsg(t_array)
+		msg.array = make([]*Msg, len(args))
+		for i, arg := range args {
+			msg.array[i] = NewBulkStringMsg(arg)
+		}
+		return msg, nil
+	}
+}
+
+func readInlineLine(br *msgReader) ([]byte, error) {
+	line, err := br.readLine()
+	if err == ErrorLineTooLong {
+		return nil, ErrorInlineTooLong
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// 参数以空白分隔, 支持双引号(可使用 \n \r \t \b \a \xHH 等转义)和单引号(仅支持 \')
+// 规则同 redis 的 sdssplitargs
+func splitInlineArgs(line []byte) (args [][]byte, err error) {
+	i, n := 0, len(line)
+	for {
+		for i < n && isInlineSpace(line[i]) {
+			i++
+		}
+		if i >= n {
+			return args, nil
+		}
+		var (
+			current    = make([]byte, 0, n-i)
+			inQuote    bool
+			inSQuote   bool
+			tokenEnded bool
+		)
+		for !tokenEnded {
+			switch {
+			case inQuote:
+				if i >= n {
+					return nil, ErrorUnbalancedQuotes
+				}
+				if line[i] == '\\' && i+3 < n && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]) {
+					current = append(current, hexDigitValue(line[i+2])<<4|hexDigitValue(line[i+3]))
+					i += 3
+				} else if line[i] == '\\' && i+1 < n {
+					i++
+					current = append(current, unescapeInline(line[i]))
+				} else if line[i] == '"' {
+					// 闭合的引号后必须是空白或行尾
+					if i+1 < n && !isInlineSpace(line[i+1]) {
+						return nil, ErrorUnbalancedQuotes
+					}
+					tokenEnded = true
+				} else {
+					current = append(current, line[i])
+				}
+			case inSQuote:
+				if i >= n {
+					return nil, ErrorUnbalancedQuotes
+				}
+				if line[i] == '\\' && i+1 < n && line[i+1] == '\'' {
+					i++
+					current = append(current, '\'')
+				} else if line[i] == '\'' {
+					if i+1 < n && !isInlineSpace(line[i+1]) {
+						return nil, ErrorUnbalancedQuotes
+					}
+					tokenEnded = true
+				} else {
+					current = append(current, line[i])
+				}
+			default:
+				if i >= n {
+					tokenEnded = true
+					break
+				}
+				switch line[i] {
+				case ' ', '\n', '\r', '\t', 0:
+					tokenEnded = true
+				case '"':
+					inQuote = true
+				case '\'':
+					inSQuote = true
+				default:
+					current = append(current, line[i])
+				}
+			}
+			if i < n {
+				i++
+			}
+		}
+		args = append(args, current)
+	}
+}
+
+func isInlineSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\v' || c == '\f'
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexDigitValue(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+func unescapeInline(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	}
+	return c
+}
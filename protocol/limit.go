@@ -0,0 +1,100 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"sync/atomic"
+)
+
+// 协议解析限制, 防止异常或恶意的请求耗尽内存, 值 <= 0 时不限制
+type Limits struct {
+	MaxBulkLen      int64 // 单个 bulk string 最大长度
+	MaxMultiBulkLen int64 // 单个 array/map/set 最大元素个数
+	MaxRequestSize  int64 // 单个消息的最大字节数
+	MaxNesting      int   // 最大嵌套层数
+}
+
+const errorPrefix = "Protocol: "
+
+var (
+	ErrorBulkTooLarge      = errors.New("Protocol: invalid bulk length")
+	ErrorMultiBulkTooLarge = errors.New("Protocol: invalid multibulk length")
+	ErrorNestingTooDeep    = errors.New("Protocol: nesting too deep")
+	ErrorRequestTooLarge   = errors.New("Protocol: request too large")
+	ErrorLineTooLong       = errors.New("Protocol: too big line")
+)
+
+var limits atomic.Value
+
+func init() {
+	limits.Store(Limits{})
+}
+
+// 只对客户端请求的解析生效, 后端响应 (如大的 SMEMBERS, LRANGE 结果) 与 redis 一样不限制
+func SetLimits(l Limits) {
+	limits.Store(l)
+}
+
+func GetLimits() Limits {
+	return limits.Load().(Limits)
+}
+
+// 解析失败是由于数据格式错误或超出限制, 而非连接错误, 此时连接中的数据已无法继续解析
+func IsProtocolError(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), errorPrefix)
+}
+
+// 与 redis 一致的协议错误响应, 如: -ERR Protocol error: invalid bulk length
+func NewProtocolErrorMsg(err error) *Msg {
+	return NewErrorMsg("ERR Protocol error: " + strings.TrimPrefix(err.Error(), errorPrefix))
+}
+
+// 读取单个消息, 记录已读取的字节数及嵌套层数
+type msgReader struct {
+	*bufio.Reader
+	limits Limits
+	// 单行的最大长度, 0 为不限制
+	maxLine int
+	size    int64
+	depth   int
+}
+
+// 读取客户端请求, 使用配置的限制
+func newRequestReader(br *bufio.Reader) *msgReader {
+	return &msgReader{Reader: br, limits: GetLimits(), maxLine: maxInlineSize}
+}
+
+// 读取后端响应, 不限制
+func newReplyReader(br *bufio.Reader) *msgReader {
+	return &msgReader{Reader: br}
+}
+
+func (r *msgReader) consume(n int64) error {
+	r.size += n
+	if r.limits.MaxRequestSize > 0 && r.size > r.limits.MaxRequestSize {
+		return ErrorRequestTooLarge
+	}
+	return nil
+}
+
+// 读取以 \n 结尾的一行, 单行长度不超过 maxLine
+func (r *msgReader) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		buf, err := r.ReadSlice(lf_suffix)
+		if r.maxLine > 0 && len(line)+len(buf) > r.maxLine {
+			return nil, ErrorLineTooLong
+		}
+		if limitErr := r.consume(int64(len(buf))); limitErr != nil {
+			return nil, limitErr
+		}
+		line = append(line, buf...)
+		if err == nil {
+			return line, nil
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+}
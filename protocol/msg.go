@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
 
 	"ncache/utils"
 	"ncache/utils/object"
@@ -28,6 +29,7 @@ var (
 	MsgReadWrite     = NewArrayMsgFormStrings([]string{"READWRITE"})
 	MsgBackProcErr   = NewErrorMsg("ERR Backend process error")
 	NullBulkString   = NewBulkStringMsg(nil)
+	MsgNull          = NewNullMsg()
 )
 
 var (
@@ -39,6 +41,11 @@ var (
 	ErrorMsgTooShort       = errors.New("Protocol: read insufficient length msg")
 	ErrorMsgParametersLen  = errors.New("Protocol: worong request parameters length")
 	ErrorNilMsg            = errors.New("Protocol: msg is nil")
+	ErrorBadDouble         = errors.New("Protocol: bad double value")
+	ErrorBadBoolean        = errors.New("Protocol: bad boolean value")
+	ErrorBadNull           = errors.New("Protocol: bad null value")
+	ErrorBadBigNumber      = errors.New("Protocol: bad big number value")
+	ErrorBadVerbatim       = errors.New("Protocol: bad verbatim string")
 )
 
 var (
@@ -78,9 +85,18 @@ func PutMsg(msg *Msg) {
 
 func NewMsgFromReader(br io.Reader) (*Msg, error) {
 	if bufr, ok := br.(*bufio.Reader); ok {
-		return readMsgFromReader(bufr)
+		return readMsgFromReader(newReplyReader(bufr))
 	} else {
-		return readMsgFromReader(bufio.NewReader(br))
+		return readMsgFromReader(newReplyReader(bufio.NewReader(br)))
+	}
+}
+
+// 读取客户端请求, 支持 inline 命令 (如 telnet, nc 发送的 PING). 后端响应需使用 NewMsgFromReader
+func NewRequestFromReader(br io.Reader) (*Msg, error) {
+	if bufr, ok := br.(*bufio.Reader); ok {
+		return readRequest(bufr)
+	} else {
+		return readRequest(bufio.NewReader(br))
 	}
 }
 
@@ -109,6 +125,47 @@ func (m *Msg) IsArray() bool {
 	return m.mtype == t_array
 }
 
+func (m *Msg) IsMap() bool {
+	return m.mtype == t_map
+}
+
+func (m *Msg) IsSet() bool {
+	return m.mtype == t_set
+}
+
+func (m *Msg) IsDouble() bool {
+	return m.mtype == t_double
+}
+
+func (m *Msg) IsBoolean() bool {
+	return m.mtype == t_boolean
+}
+
+func (m *Msg) IsNull() bool {
+	return m.mtype == t_null
+}
+
+func (m *Msg) IsBigNumber() bool {
+	return m.mtype == t_big_number
+}
+
+func (m *Msg) IsVerbatim() bool {
+	return m.mtype == t_verbatim
+}
+
+func (m *Msg) IsPush() bool {
+	return m.mtype == t_push
+}
+
+// RESP3 新增的类型, RESP2 客户端无法识别
+func (m *Msg) IsResp3() bool {
+	switch m.mtype {
+	case t_map, t_set, t_double, t_boolean, t_null, t_big_number, t_verbatim, t_push:
+		return true
+	}
+	return false
+}
+
 //todo:
 func NewSimpleStringMsg(value string) (msg *Msg) {
 	msg = &Msg{
@@ -158,8 +215,76 @@ func NewErrorMsg(errInfo string) (msg *Msg) {
 	return
 }
 
+// map 的 key, value 依次平铺存放
+func NewMapMsg(array []*Msg) (msg *Msg) {
+	msg = &Msg{
+		mtype: t_map,
+		array: array,
+	}
+	return
+}
+
+func NewSetMsg(array []*Msg) (msg *Msg) {
+	msg = &Msg{
+		mtype: t_set,
+		array: array,
+	}
+	return
+}
+
+func NewPushMsg(array []*Msg) (msg *Msg) {
+	msg = &Msg{
+		mtype: t_push,
+		array: array,
+	}
+	return
+}
+
+func NewDoubleMsg(value float64) (msg *Msg) {
+	msg = &Msg{
+		mtype: t_double,
+		value: []byte(strconv.FormatFloat(value, 'g', -1, 64)),
+	}
+	return
+}
+
+func NewBooleanMsg(value bool) (msg *Msg) {
+	msg = &Msg{
+		mtype: t_boolean,
+		value: []byte{'f'},
+	}
+	if value {
+		msg.value = []byte{'t'}
+	}
+	return
+}
+
+func NewNullMsg() (msg *Msg) {
+	msg = &Msg{
+		mtype: t_null,
+	}
+	return
+}
+
+func NewBigNumberMsg(value string) (msg *Msg) {
+	msg = &Msg{
+		mtype: t_big_number,
+		value: []byte(value),
+	}
+	return
+}
+
+// format 为三个字符的编码, 如 txt, mkd
+func NewVerbatimMsg(format string, value []byte) (msg *Msg) {
+	msg = &Msg{
+		mtype: t_verbatim,
+		value: append([]byte(format+":"), value...),
+	}
+	return
+}
+
 func NewErrorMsgFmt(format string, a ...interface{}) (msg *Msg) {
-	s := utils.GetStringFmt(format, a)
+	s := utils.GetStringFmt(format, a...)
 	msg = &Msg{
 		mtype: t_error,
 		value: []byte(s),
@@ -180,6 +305,28 @@ func (this *Msg) WriteMsg(writer io.Writer) error {
 	return err
 }
 
+// 只写入缓冲区, 不 flush, 用于批量写入后统一 flush
+func (this *Msg) WriteMsgBuffered(bw *bufio.Writer) error {
+	return writeMsg(bw, this)
+}
+
+// 批量写入消息, 只 flush 一次
+func WriteMultiMsg(writer io.Writer, msgList []*Msg) error {
+	var (
+		bw *bufio.Writer
+		ok bool
+	)
+	if bw, ok = writer.(*bufio.Writer); !ok {
+		bw = bufio.NewWriter(writer)
+	}
+	for _, msg := range msgList {
+		if err := writeMsg(bw, msg); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
 func (this *Msg) WriteToBytes() ([]byte, error) {
 	var b = &bytes.Buffer{}
 	if err := this.WriteMsg(bufio.NewWriter(b)); err != nil {
@@ -200,6 +347,22 @@ func errorWrongMsgType(mtype MsgType) error {
 		return fmt.Errorf(ErrorMsgTypeFormat, "bulk string")
 	case t_array:
 		return fmt.Errorf(ErrorMsgTypeFormat, "array")
+	case t_map:
+		return fmt.Errorf(ErrorMsgTypeFormat, "map")
+	case t_set:
+		return fmt.Errorf(ErrorMsgTypeFormat, "set")
+	case t_double:
+		return fmt.Errorf(ErrorMsgTypeFormat, "double")
+	case t_boolean:
+		return fmt.Errorf(ErrorMsgTypeFormat, "boolean")
+	case t_null:
+		return fmt.Errorf(ErrorMsgTypeFormat, "null")
+	case t_big_number:
+		return fmt.Errorf(ErrorMsgTypeFormat, "big number")
+	case t_verbatim:
+		return fmt.Errorf(ErrorMsgTypeFormat, "verbatim string")
+	case t_push:
+		return fmt.Errorf(ErrorMsgTypeFormat, "push")
 	default:
 		return ErrorUnknowMessageType
 	}
@@ -234,8 +397,11 @@ func (this *Msg) GetStr() (string, error) {
 	if this == nil {
 		return "", ErrorNilMsg
 	}
-	if this.IsBulk() || this.IsSimpleString() || this.IsError() {
+	if this.IsBulk() || this.IsSimpleString() || this.IsError() ||
+		this.IsDouble() || this.IsBigNumber() {
 		return string(this.value), nil
+	} else if this.IsVerbatim() {
+		return string(this.value[verbatimPrefixLen:]), nil
 	} else if this.IsInt() {
 		val := this.GetInt()
 		return fmt.Sprint(val), nil
@@ -245,6 +411,10 @@ func (this *Msg) GetStr() (string, error) {
 	return "", ErrorUncompletedMsg
 }
 
+func (this *Msg) GetBool() bool {
+	return len(this.value) == 1 && this.value[0] == 't'
+}
+
 func (this *Msg) GetArray() []*Msg {
 	return this.array
 }
@@ -288,6 +458,12 @@ func NewCmdMsg(cmd string) *Msg {
 	msg := &Msg{
 		mtype: t_array,
 	}
+	if args, err := splitInlineArgs([]byte(cmd)); err == nil {
+		for _, arg := range args {
+			msg.array = append(msg.array, NewBulkStringMsg(arg))
+		}
+		return msg
+	}
 	list := strings.Split(cmd, " ")
 	for _, v := range list {
 		v = strings.TrimSpace(v)
@@ -338,7 +514,17 @@ func (this *Msg) String() string {
 			return "(bulk) nil"
 		}
 		return "(bulk) " + string(this.value)
-	case t_array:
+	case t_double:
+		return "(double) " + string(this.value)
+	case t_boolean:
+		return "(boolean) " + string(this.value)
+	case t_null:
+		return "(null)"
+	case t_big_number:
+		return "(big number) " + string(this.value)
+	case t_verbatim:
+		return "(verbatim) " + string(this.value)
+	case t_array, t_set, t_push, t_map:
 		a := make([]string, 0)
 		for i, v := range this.array {
 			if v.value == nil {
@@ -353,6 +539,55 @@ func (this *Msg) String() string {
 	}
 }
 
+// 将 RESP3 类型转换为 RESP2 中对应的类型, 用于未通过 HELLO 3 升级协议的客户端
+// 不包含 RESP3 类型时返回原消息
+func (this *Msg) ToResp2() *Msg {
+	if this == nil {
+		return nil
+	}
+	switch this.mtype {
+	case t_map, t_set, t_push:
+		array, _ := toResp2Array(this.array)
+		if array == nil {
+			array = []*Msg{}
+		}
+		return NewArrayMsg(array)
+	case t_array:
+		if array, converted := toResp2Array(this.array); converted {
+			return NewArrayMsg(array)
+		}
+		return this
+	case t_double, t_big_number:
+		return NewBulkStringMsg(this.value)
+	case t_verbatim:
+		return NewBulkStringMsg(this.value[verbatimPrefixLen:])
+	case t_boolean:
+		if this.GetBool() {
+			return NewIntegerMsg(1)
+		}
+		return NewIntegerMsg(0)
+	case t_null:
+		return NullBulkString
+	}
+	return this
+}
+
+func toResp2Array(array []*Msg) (result []*Msg, converted bool) {
+	result = array
+	for i, m := range array {
+		c := m.ToResp2()
+		if c != m && !converted {
+			converted = true
+			result = make([]*Msg, len(array))
+			copy(result, array[:i])
+		}
+		if converted {
+			result[i] = c
+		}
+	}
+	return
+}
+
 func NewErrMsgFormat(format string, a ...interface{}) *Msg {
 	s := fmt.Sprintf(format, a...)
 	return NewErrorMsg(s)
@@ -2,7 +2,9 @@ package protocol
 
 import (
 	"bytes"
+	"io"
 	"strconv"
+	"strings"
 	"testing"
 
 	"ncache/utils"
@@ -123,9 +125,7 @@ func TestMsg_GetInt(t *testing.T) {
 	var i int64 = -32768
 	for ; i < 32768; i++ {
 		msg := NewIntegerMsg(i)
-		ret, err := msg.GetInt()
-		utils.AssertMustNoError(err)
-		utils.AssertMust(ret == i)
+		utils.AssertMust(msg.GetInt() == i)
 	}
 }
 
@@ -145,3 +145,171 @@ func TestMsg_GetString(t *testing.T) {
 		utils.AssertMust(s == ret)
 	}
 }
+
+func TestReadResp3Msg(t *testing.T) {
+	test := []string{
+		"%2\r\n+first\r\n:1\r\n+second\r\n:2\r\n",
+		"~3\r\n+orange\r\n+apple\r\n#t\r\n",
+		",1.23\r\n",
+		",inf\r\n",
+		",-inf\r\n",
+		"#t\r\n",
+		"#f\r\n",
+		"_\r\n",
+		"(3492890328409238509324850943850943825024385\r\n",
+		"=15\r\ntxt:Some string\r\n",
+		">2\r\n+message\r\n$5\r\nhello\r\n",
+		"*2\r\n%1\r\n+key\r\n_\r\n~0\r\n",
+	}
+	for _, s := range test {
+		msg, err := NewFromBytes([]byte(s))
+		utils.AssertMustNoError(err)
+		testEncodeAndCheck(t, msg, []byte(s))
+	}
+}
+
+func TestDecodeInvalidResp3Msg(t *testing.T) {
+	test := []string{
+		"%1\r\n+first\r\n",
+		"%-1\r\n",
+		"~-1\r\n",
+		",abc\r\n",
+		"#x\r\n",
+		"#\r\n",
+		"_x\r\n",
+		"(12a\r\n",
+		"=3\r\ntxt\r\n",
+	}
+	for _, s := range test {
+		_, err := NewFromBytes([]byte(s))
+		utils.AssertMust(err != nil)
+	}
+}
+
+func TestMsg_ToResp2(t *testing.T) {
+	test := map[string]string{
+		"%1\r\n+key\r\n#t\r\n":         "*2\r\n+key\r\n:1\r\n",
+		"~2\r\n,1.5\r\n#f\r\n":         "*2\r\n$3\r\n1.5\r\n:0\r\n",
+		"_\r\n":                        "$-1\r\n",
+		"(12345678901234567890\r\n":    "$20\r\n12345678901234567890\r\n",
+		"=9\r\ntxt:hello\r\n":          "$5\r\nhello\r\n",
+		">1\r\n+message\r\n":           "*1\r\n+message\r\n",
+		"*2\r\n$1\r\na\r\n%0\r\n":      "*2\r\n$1\r\na\r\n*0\r\n",
+		"*2\r\n$1\r\na\r\n$1\r\nb\r\n": "*2\r\n$1\r\na\r\n$1\r\nb\r\n",
+	}
+	for s, expect := range test {
+		msg, err := NewFromBytes([]byte(s))
+		utils.AssertMustNoError(err)
+		testEncodeAndCheck(t, msg.ToResp2(), []byte(expect))
+	}
+}
+
+func TestReadInlineMsg(t *testing.T) {
+	test := map[string][]string{
+		"PING\r\n":                         {"PING"},
+		"PING\n":                           {"PING"},
+		"\r\n\r\nPING\r\n":                 {"PING"},
+		"  set  key   value \r\n":          {"set", "key", "value"},
+		"set key \"hello world\"\r\n":      {"set", "key", "hello world"},
+		"set key \"a\\tb\\x41\\\"\"\r\n":   {"set", "key", "a\tbA\""},
+		"set key 'it\\'s'\r\n":             {"set", "key", "it's"},
+		"set key 'a\\nb'\r\n":              {"set", "key", "a\\nb"},
+		"set key \"\"\r\n":                 {"set", "key", ""},
+		"echo \"multi\" 'quoted' args\r\n": {"echo", "multi", "quoted", "args"},
+		// 请求中只有 * 表示 RESP, 其他前缀按 inline 命令处理
+		"+PING\r\n":    {"+PING"},
+		"#hello 3\r\n": {"#hello", "3"},
+		"_ping\r\n":    {"_ping"},
+	}
+	for s, expect := range test {
+		msg, err := NewRequestFromReader(bytes.NewReader([]byte(s)))
+		utils.AssertMustNoError(err)
+		utils.AssertMust(msg.IsBulkStringArray())
+		args, err := msg.Args()
+		utils.AssertMustNoError(err)
+		utils.AssertMust(utils.DeepEqual(args, expect))
+	}
+}
+
+func TestReadInvalidInlineMsg(t *testing.T) {
+	test := []string{
+		"set key \"value\r\n",
+		"set key 'value\r\n",
+		"set key \"value\"x\r\n",
+		"set key 'value'x\r\n",
+		"\r\n",
+		"PING",
+		"GET " + strings.Repeat("x", maxInlineSize) + "\r\n",
+	}
+	for _, s := range test {
+		_, err := NewRequestFromReader(bytes.NewReader([]byte(s)))
+		utils.AssertMust(err != nil)
+	}
+	// 后端响应不支持 inline, 无法识别的类型直接报错
+	_, err := NewFromBytes([]byte("PING\r\n"))
+	utils.AssertMust(err == ErrorUnknowMessageType)
+}
+
+func TestReadMsgWithLimits(t *testing.T) {
+	defer SetLimits(GetLimits())
+	SetLimits(Limits{
+		MaxBulkLen:      8,
+		MaxMultiBulkLen: 4,
+		MaxRequestSize:  48,
+		MaxNesting:      2,
+	})
+	valid := []string{
+		"*2\r\n$3\r\nGET\r\n$8\r\n12345678\r\n",
+		"*1\r\n*1\r\n:1\r\n",
+		"*1\r\n%2\r\n+a\r\n:1\r\n+b\r\n:2\r\n",
+		"PING\r\n",
+	}
+	for _, s := range valid {
+		_, err := NewRequestFromReader(bytes.NewReader([]byte(s)))
+		utils.AssertMustNoError(err)
+	}
+	invalid := map[string]error{
+		"*1\r\n$9\r\n123456789\r\n":            ErrorBulkTooLarge,
+		"*1\r\n$1073741824\r\n":                ErrorBulkTooLarge,
+		"*5\r\n:1\r\n:2\r\n:3\r\n:4\r\n:5\r\n": ErrorMultiBulkTooLarge,
+		"*2147483647\r\n":                      ErrorMultiBulkTooLarge,
+		"*1\r\n%3\r\n":                         ErrorMultiBulkTooLarge,
+		"*1\r\n*1\r\n*1\r\n:1\r\n":             ErrorNestingTooDeep,
+		"*4\r\n$8\r\n12345678\r\n$8\r\n12345678\r\n$8\r\n12345678\r\n$8\r\n12345678\r\n": ErrorRequestTooLarge,
+		"*1\r\n+" + strings.Repeat("x", 128) + "\r\n":                                    ErrorRequestTooLarge,
+		"*hello\r\n":     ErrorBadArrayLen,
+		"*1\r\n$abc\r\n": ErrorBadBulkMsgLen,
+	}
+	for s, expect := range invalid {
+		_, err := NewRequestFromReader(bytes.NewReader([]byte(s)))
+		utils.AssertMust(err == expect)
+		utils.AssertMust(IsProtocolError(err))
+	}
+	// 后端响应不受限制
+	replies := []string{
+		"$9\r\n123456789\r\n",
+		"*5\r\n:1\r\n:2\r\n:3\r\n:4\r\n:5\r\n",
+		"%3\r\n+a\r\n:1\r\n+b\r\n:2\r\n+c\r\n:3\r\n",
+		"*1\r\n*1\r\n*1\r\n:1\r\n",
+		"+" + strings.Repeat("x", maxInlineSize) + "\r\n",
+	}
+	for _, s := range replies {
+		_, err := NewFromBytes([]byte(s))
+		utils.AssertMustNoError(err)
+	}
+}
+
+func TestNewProtocolErrorMsg(t *testing.T) {
+	msg := NewProtocolErrorMsg(ErrorBulkTooLarge)
+	testEncodeAndCheck(t, msg, []byte("-ERR Protocol error: invalid bulk length\r\n"))
+	utils.AssertMust(!IsProtocolError(io.EOF))
+	utils.AssertMust(!IsProtocolError(nil))
+}
+
+func TestWriteMultiMsg(t *testing.T) {
+	var b bytes.Buffer
+	msgList := []*Msg{NewCmdMsg("SET a 1"), NewCmdMsg("GET a"), MsgPING}
+	utils.AssertMustNoError(WriteMultiMsg(&b, msgList))
+	expect := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n*2\r\n$3\r\nGET\r\n$1\r\na\r\n+PING\r\n"
+	utils.AssertMust(b.String() == expect)
+}
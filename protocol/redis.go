@@ -3,6 +3,9 @@ package protocol
 import (
 	"bufio"
 	"io"
+	"math"
+	"math/big"
+	"strconv"
 
 	"github.com/pkg/errors"
 	"ncache/utils"
@@ -15,19 +18,47 @@ const (
 	t_bulk_string   MsgType = '$' //24 -- 36
 	t_array         MsgType = '*' //2a -- 42
 
+	// RESP3
+	t_map        MsgType = '%' //25 -- 37
+	t_set        MsgType = '~' //7e -- 126
+	t_double     MsgType = ',' //2c -- 44
+	t_boolean    MsgType = '#' //23 -- 35
+	t_null       MsgType = '_' //5f -- 95
+	t_big_number MsgType = '(' //28 -- 40
+	t_verbatim   MsgType = '=' //3d -- 61
+	t_push       MsgType = '>' //3e -- 62
+
 	cr_suffix = byte('\r')
 	lf_suffix = byte('\n')
+
+	verbatimPrefixLen = 4
 )
 
 var (
 	crlf = []byte{cr_suffix, lf_suffix}
 )
 
-func readMsgFromReader(br *bufio.Reader) (*Msg, error) {
+// 与 redis 一致, 客户端请求只有以 * 开头时按 RESP 解析, 其余均按 inline 命令解析
+func readRequest(bufReader *bufio.Reader) (*Msg, error) {
+	br := newRequestReader(bufReader)
+	prefix, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if MsgType(prefix[0]) != t_array {
+		return readInline(br)
+	}
+	return readMsgFromReader(br)
+}
+
+func readMsgFromReader(br *msgReader) (*Msg, error) {
 	prefix, err := br.ReadByte()
 	if err != nil {
 		return nil, err
 	}
+	if err = br.consume(1); err != nil {
+		return nil, err
+	}
 	switch MsgType(prefix) {
 	case t_simple_string:
 		return readSimpleString(br)
@@ -39,16 +70,30 @@ func readMsgFromReader(br *bufio.Reader) (*Msg, error) {
 		return readArray(br)
 	case t_error:
 		return readError(br)
+	case t_map:
+		return readMap(br)
+	case t_set, t_push:
+		return readAggregate(br, MsgType(prefix))
+	case t_double:
+		return readDouble(br)
+	case t_boolean:
+		return readBoolean(br)
+	case t_null:
+		return readNull(br)
+	case t_big_number:
+		return readBigNumber(br)
+	case t_verbatim:
+		return readVerbatim(br)
 	}
 	return nil, ErrorUnknowMessageType
 }
 
-func readToCRLF(bufReader *bufio.Reader) ([]byte, error) {
+func readToCRLF(br *msgReader) ([]byte, error) {
 	var (
 		buf []byte
 		err error
 	)
-	if buf, err = bufReader.ReadBytes(lf_suffix); err != nil {
+	if buf, err = br.readLine(); err != nil {
 		return nil, err
 	}
 
@@ -62,7 +107,7 @@ func readToCRLF(bufReader *bufio.Reader) ([]byte, error) {
 	return buf[:n], nil
 }
 
-func readGeneric(br *bufio.Reader, mtype MsgType) (msg *Msg, err error) {
+func readGeneric(br *msgReader, mtype MsgType) (msg *Msg, err error) {
 	msg = getMsg(mtype)
 	var buf []byte
 	if buf, err = readToCRLF(br); err != nil {
@@ -72,19 +117,72 @@ func readGeneric(br *bufio.Reader, mtype MsgType) (msg *Msg, err error) {
 	return
 }
 
-func readSimpleString(br *bufio.Reader) (*Msg, error) {
+func readSimpleString(br *msgReader) (*Msg, error) {
 	return readGeneric(br, t_simple_string)
 }
 
-func readError(br *bufio.Reader) (*Msg, error) {
+func readError(br *msgReader) (*Msg, error) {
 	return readGeneric(br, t_error)
 }
 
-func readInteger(br *bufio.Reader) (*Msg, error) {
+func readInteger(br *msgReader) (*Msg, error) {
 	return readGeneric(br, t_integer)
 }
 
-func readBulkStrings(br *bufio.Reader) (msg *Msg, err error) {
+func readDouble(br *msgReader) (msg *Msg, err error) {
+	if msg, err = readGeneric(br, t_double); err != nil {
+		return nil, err
+	}
+	if _, err = strconv.ParseFloat(string(msg.value), 64); err != nil {
+		return nil, ErrorBadDouble
+	}
+	return
+}
+
+func readBoolean(br *msgReader) (msg *Msg, err error) {
+	if msg, err = readGeneric(br, t_boolean); err != nil {
+		return nil, err
+	}
+	if len(msg.value) != 1 || (msg.value[0] != 't' && msg.value[0] != 'f') {
+		return nil, ErrorBadBoolean
+	}
+	return
+}
+
+func readNull(br *msgReader) (msg *Msg, err error) {
+	if msg, err = readGeneric(br, t_null); err != nil {
+		return nil, err
+	}
+	if len(msg.value) != 0 {
+		return nil, ErrorBadNull
+	}
+	msg.value = nil
+	return
+}
+
+func readBigNumber(br *msgReader) (msg *Msg, err error) {
+	if msg, err = readGeneric(br, t_big_number); err != nil {
+		return nil, err
+	}
+	if _, ok := new(big.Int).SetString(string(msg.value), 10); !ok {
+		return nil, ErrorBadBigNumber
+	}
+	return
+}
+
+func readVerbatim(br *msgReader) (msg *Msg, err error) {
+	if msg, err = readBulkStrings(br); err != nil {
+		return nil, err
+	}
+	// 格式: <3字节编码>:<内容>, 如 txt:hello
+	if len(msg.value) < verbatimPrefixLen || msg.value[verbatimPrefixLen-1] != ':' {
+		return nil, ErrorBadVerbatim
+	}
+	msg.mtype = t_verbatim
+	return
+}
+
+func readBulkStrings(br *msgReader) (msg *Msg, err error) {
 	msg = getMsg(t_bulk_string)
 	var (
 		buf      []byte
@@ -94,7 +192,7 @@ func readBulkStrings(br *bufio.Reader) (msg *Msg, err error) {
 		return nil, err
 	}
 	if valueLen, err = utils.BytesToInt64(buf); err != nil {
-		return
+		return nil, ErrorBadBulkMsgLen
 	}
 
 	switch {
@@ -103,6 +201,12 @@ func readBulkStrings(br *bufio.Reader) (msg *Msg, err error) {
 	case valueLen == -1:
 		msg.value = nil
 		return
+	case br.limits.MaxBulkLen > 0 && valueLen > br.limits.MaxBulkLen:
+		return nil, ErrorBulkTooLarge
+	}
+	// 先检查总长度再分配内存
+	if err = br.consume(valueLen + 2); err != nil {
+		return nil, err
 	}
 
 	buf = make([]byte, int(valueLen)+2)
@@ -116,8 +220,17 @@ func readBulkStrings(br *bufio.Reader) (msg *Msg, err error) {
 	return
 }
 
-func readArray(br *bufio.Reader) (msg *Msg, err error) {
-	msg = getMsg(t_array)
+func readArray(br *msgReader) (msg *Msg, err error) {
+	return readAggregate(br, t_array)
+}
+
+// map 的元素按 key, value 依次平铺存放在 array 中
+func readMap(br *msgReader) (msg *Msg, err error) {
+	return readAggregate(br, t_map)
+}
+
+func readAggregate(br *msgReader, mtype MsgType) (msg *Msg, err error) {
+	msg = getMsg(mtype)
 	var (
 		buf      []byte
 		msgLen   int64
@@ -127,15 +240,35 @@ func readArray(br *bufio.Reader) (msg *Msg, err error) {
 		return nil, err
 	}
 	if msgLen, err = utils.BytesToInt64(buf); err != nil {
-		return nil, err
+		return nil, ErrorBadArrayLen
 	}
 	switch {
 	case msgLen < -1:
 		return nil, ErrorBadArrayLen
 	case msgLen == -1:
+		if mtype != t_array {
+			return nil, ErrorBadArrayLen
+		}
 		msg.array = nil
 		return
 	}
+	if mtype == t_map {
+		if msgLen > math.MaxInt32 {
+			return nil, ErrorMultiBulkTooLarge
+		}
+		msgLen *= 2
+	}
+	if br.limits.MaxMultiBulkLen > 0 && msgLen > br.limits.MaxMultiBulkLen {
+		return nil, ErrorMultiBulkTooLarge
+	}
+	// 每个元素至少占用 3 个字节, 超出剩余长度时无需分配
+	if br.limits.MaxRequestSize > 0 && msgLen > (br.limits.MaxRequestSize-br.size)/3 {
+		return nil, ErrorRequestTooLarge
+	}
+	if br.depth++; br.limits.MaxNesting > 0 && br.depth > br.limits.MaxNesting {
+		return nil, ErrorNestingTooDeep
+	}
+	defer func() { br.depth-- }()
 	msgArray = make([]*Msg, msgLen)
 	var i int64 = 0
 	for ; i < msgLen; i++ {
@@ -155,12 +288,16 @@ func writeMsg(bw *bufio.Writer, msg *Msg) error {
 		return err
 	}
 	switch msg.mtype {
-	case t_simple_string, t_integer, t_error:
+	case t_simple_string, t_integer, t_error, t_double, t_boolean, t_big_number:
 		err = writeBytesWithCRLF(bw, msg.value)
-	case t_bulk_string:
+	case t_bulk_string, t_verbatim:
 		err = writeBulkString(bw, msg.value)
-	case t_array:
+	case t_array, t_set, t_push:
 		err = writeArray(bw, msg.array)
+	case t_map:
+		err = writeMap(bw, msg.array)
+	case t_null:
+		_, err = bw.Write(crlf)
 	}
 	return err
 }
@@ -207,6 +344,18 @@ func writeArray(bw *bufio.Writer, array []*Msg) error {
 	}
 }
 
+func writeMap(bw *bufio.Writer, array []*Msg) error {
+	if err := writeInt(bw, int64(len(array)/2)); err != nil {
+		return err
+	}
+	for _, msg := range array {
+		if err := writeMsg(bw, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func Ping(reader io.Reader, writer io.Writer) error {
 	err := NewCmdMsg("PING").WriteMsg(writer)
 	if err == nil {
@@ -226,3 +375,11 @@ func Ping(reader io.Reader, writer io.Writer) error {
 func IsOkMsg(msg *Msg) bool {
 	return msg != nil && msg.mtype == t_simple_string && string(msg.value) == OK
 }
+
+// key 不存在时的响应, 如 GET 返回的 nil
+func IsNilMsg(msg *Msg) bool {
+	if msg == nil || msg.IsNull() {
+		return true
+	}
+	return msg.IsBulk() && msg.value == nil
+}
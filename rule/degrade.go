@@ -1 +1,348 @@
 package rule
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"ncache/config"
+	"ncache/protocol"
+	"ncache/stat"
+)
+
+// 熔断器状态
+const (
+	BreakerClosed   = iota // 正常转发
+	BreakerOpen            // 熔断, 请求按降级规则处理
+	BreakerHalfOpen        // 放行少量请求探测是否恢复
+)
+
+const (
+	ActionFail = "fail" // 直接返回错误
+	ActionNil  = "nil"  // 读请求返回 nil
+	ActionOk   = "ok"   // 写请求丢弃并返回 OK
+
+	defaultWindow           = 10 // s
+	defaultMinRequests      = 20
+	defaultOpenTime         = 5 // s
+	defaultHalfOpenRequests = 3
+
+	statBreakerTrips = "breaker_trips"
+	statDegraded     = "degraded_requests"
+)
+
+var ErrBreakerOpen = errors.New("circuit breaker open")
+
+// read_action 为 nil 时, 按 key 不存在构造与原命令类型一致的响应
+var nilReplies = map[string]func(args []string) *protocol.Msg{
+	"GET":           nullReply,
+	"HGET":          nullReply,
+	"LINDEX":        nullReply,
+	"ZSCORE":        nullReply,
+	"MGET":          func(args []string) *protocol.Msg { return nullArrayReply(len(args) - 1) },
+	"HMGET":         func(args []string) *protocol.Msg { return nullArrayReply(len(args) - 2) },
+	"HGETALL":       emptyArrayReply,
+	"HKEYS":         emptyArrayReply,
+	"HVALS":         emptyArrayReply,
+	"SMEMBERS":      emptyArrayReply,
+	"LRANGE":        emptyArrayReply,
+	"ZRANGE":        emptyArrayReply,
+	"ZREVRANGE":     emptyArrayReply,
+	"ZRANGEBYSCORE": emptyArrayReply,
+	"EXISTS":        zeroReply,
+	"STRLEN":        zeroReply,
+	"HLEN":          zeroReply,
+	"HEXISTS":       zeroReply,
+	"LLEN":          zeroReply,
+	"SCARD":         zeroReply,
+	"SISMEMBER":     zeroReply,
+	"ZCARD":         zeroReply,
+	"TTL":           noKeyTtlReply,
+	"PTTL":          noKeyTtlReply,
+}
+
+// write_action 为 ok 时可以丢弃的写命令, 成功时的响应均为 OK
+var okCmds = map[string]bool{
+	"SET":    true,
+	"SETEX":  true,
+	"PSETEX": true,
+	"MSET":   true,
+	"HMSET":  true,
+	"LSET":   true,
+	"LTRIM":  true,
+}
+
+func nullReply(args []string) *protocol.Msg {
+	return protocol.NullBulkString
+}
+
+func nullArrayReply(n int) *protocol.Msg {
+	array := make([]*protocol.Msg, n)
+	for i := range array {
+		array[i] = protocol.NullBulkString
+	}
+	return protocol.NewArrayMsg(array)
+}
+
+func emptyArrayReply(args []string) *protocol.Msg {
+	return protocol.NewArrayMsg([]*protocol.Msg{})
+}
+
+func zeroReply(args []string) *protocol.Msg {
+	return protocol.NewIntegerMsg(0)
+}
+
+// key 不存在时 TTL 返回 -2
+func noKeyTtlReply(args []string) *protocol.Msg {
+	return protocol.NewIntegerMsg(-2)
+}
+
+// SET 带 GET 选项时返回旧值, 不能以 OK 代替
+func isOkCmd(cmd string, args []string) bool {
+	if !okCmds[cmd] {
+		return false
+	}
+	if cmd == "SET" && len(args) > 3 {
+		for _, arg := range args[3:] {
+			if strings.ToUpper(arg) == "GET" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+var (
+	// 同名时以最后创建的为准, 如重新加载时新旧 Db 短暂共存
+	breakers      = make(map[string]*Breaker)
+	breakerRWLock sync.RWMutex
+)
+
+func init() {
+	stat.RegisterInfo(breakerInfo)
+}
+
+// 每个熔断器的当前状态, 如 breaker_state_feed_10.0.0.1_6379:1
+func breakerInfo() map[string]int64 {
+	breakerRWLock.RLock()
+	defer breakerRWLock.RUnlock()
+	info := make(map[string]int64, len(breakers))
+	for name, breaker := range breakers {
+		info["breaker_state_"+name] = int64(breaker.State())
+	}
+	return info
+}
+
+// 按统计窗口内的错误率及慢请求比例熔断, 熔断 openTime 后进入半开状态,
+// 半开状态下放行 halfOpenRequests 个请求, 全部成功后恢复, 任一失败则重新熔断
+type Breaker struct {
+	name             string
+	window           time.Duration
+	slowThreshold    time.Duration
+	openTime         time.Duration
+	errorRate        float64
+	slowRate         float64
+	readAction       string
+	writeAction      string
+	mutex            sync.Mutex
+	windowStart      time.Time
+	openedAt         time.Time
+	minRequests      int
+	halfOpenRequests int
+	total            int
+	failed           int
+	slow             int
+	probes           int
+	probeOk          int
+	state            int
+	// 每次状态变化时加 1, 之前放行的请求结束时不再计入
+	generation uint64
+}
+
+// conf 为 nil 时返回 nil, 不熔断. name 用于状态统计, 如 backend 名称及节点地址.
+// 创建后需调用 Close 注销状态统计
+func NewBreaker(name string, conf *config.DegradeConf) (*Breaker, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	breaker := &Breaker{
+		name:             strings.Replace(name, ":", "_", -1),
+		window:           time.Duration(conf.Window) * time.Second,
+		slowThreshold:    time.Duration(conf.SlowThreshold) * time.Millisecond,
+		openTime:         time.Duration(conf.OpenTime) * time.Second,
+		errorRate:        conf.ErrorRate,
+		slowRate:         conf.SlowRate,
+		readAction:       strings.ToLower(conf.ReadAction),
+		writeAction:      strings.ToLower(conf.WriteAction),
+		minRequests:      conf.MinRequests,
+		halfOpenRequests: conf.HalfOpenRequests,
+		windowStart:      time.Now(),
+	}
+	if breaker.window <= 0 {
+		breaker.window = defaultWindow * time.Second
+	}
+	if breaker.openTime <= 0 {
+		breaker.openTime = defaultOpenTime * time.Second
+	}
+	if breaker.minRequests <= 0 {
+		breaker.minRequests = defaultMinRequests
+	}
+	if breaker.halfOpenRequests <= 0 {
+		breaker.halfOpenRequests = defaultHalfOpenRequests
+	}
+	if breaker.readAction == "" {
+		breaker.readAction = ActionFail
+	}
+	if breaker.writeAction == "" {
+		breaker.writeAction = ActionFail
+	}
+	if breaker.readAction != ActionFail && breaker.readAction != ActionNil {
+		return nil, fmt.Errorf("Rule: invalid read action %s", conf.ReadAction)
+	}
+	if breaker.writeAction != ActionFail && breaker.writeAction != ActionOk {
+		return nil, fmt.Errorf("Rule: invalid write action %s", conf.WriteAction)
+	}
+	breakerRWLock.Lock()
+	breakers[breaker.name] = breaker
+	breakerRWLock.Unlock()
+	return breaker, nil
+}
+
+func (this *Breaker) Close() {
+	if this == nil {
+		return
+	}
+	breakerRWLock.Lock()
+	if breakers[this.name] == this {
+		delete(breakers, this.name)
+	}
+	breakerRWLock.Unlock()
+}
+
+func (this *Breaker) State() int {
+	if this == nil {
+		return BreakerClosed
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.state
+}
+
+// 是否放行请求, 放行的请求处理完后需以返回的 generation 调用 Done
+func (this *Breaker) Allow() (generation uint64, ok bool) {
+	if this == nil {
+		return 0, true
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	switch this.state {
+	case BreakerOpen:
+		if time.Since(this.openedAt) < this.openTime {
+			return 0, false
+		}
+		this.setState(BreakerHalfOpen)
+		this.probes, this.probeOk = 0, 0
+		fallthrough
+	case BreakerHalfOpen:
+		if this.probes >= this.halfOpenRequests {
+			return 0, false
+		}
+		this.probes++
+	}
+	return this.generation, true
+}
+
+// 记录请求结果, err 为连接错误等后端故障, redis 返回的错误响应不计入.
+// 放行后熔断器状态已变化的请求 (如熔断前开始的慢请求) 不计入, 避免被当作半开状态的探测请求
+func (this *Breaker) Done(generation uint64, err error, cost time.Duration) {
+	if this == nil {
+		return
+	}
+	isSlow := this.slowThreshold > 0 && cost >= this.slowThreshold
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if generation != this.generation {
+		return
+	}
+	switch this.state {
+	case BreakerHalfOpen:
+		if err != nil || isSlow {
+			this.trip()
+			return
+		}
+		if this.probeOk++; this.probeOk >= this.halfOpenRequests {
+			this.setState(BreakerClosed)
+			this.resetWindow(time.Now())
+		}
+	case BreakerClosed:
+		now := time.Now()
+		if now.Sub(this.windowStart) >= this.window {
+			this.resetWindow(now)
+		}
+		this.total++
+		if err != nil {
+			this.failed++
+		}
+		if isSlow {
+			this.slow++
+		}
+		if this.total < this.minRequests {
+			return
+		}
+		if (this.errorRate > 0 && float64(this.failed) >= this.errorRate*float64(this.total)) ||
+			(this.slowRate > 0 && float64(this.slow) >= this.slowRate*float64(this.total)) {
+			this.trip()
+		}
+	}
+}
+
+// 需持有锁
+func (this *Breaker) trip() {
+	this.setState(BreakerOpen)
+	this.openedAt = time.Now()
+	stat.Incr(statBreakerTrips, 1)
+}
+
+// 需持有锁
+func (this *Breaker) setState(state int) {
+	this.state = state
+	this.generation++
+}
+
+// 需持有锁
+func (this *Breaker) resetWindow(now time.Time) {
+	this.windowStart = now
+	this.total, this.failed, this.slow = 0, 0, 0
+}
+
+// 熔断时按降级规则生成响应, 无法构造与原命令类型一致的响应时返回 ErrBreakerOpen
+func (this *Breaker) Degrade(msg *protocol.Msg) (*protocol.Msg, error) {
+	stat.Incr(statDegraded, 1)
+	args, err := msg.Args()
+	if err != nil || len(args) < 2 {
+		return nil, ErrBreakerOpen
+	}
+	cmd := strings.ToUpper(args[0])
+	if fn, ok := nilReplies[cmd]; ok && this.readAction == ActionNil {
+		return fn(args), nil
+	}
+	if this.writeAction == ActionOk && isOkCmd(cmd, args) {
+		return protocol.MsgOK, nil
+	}
+	return nil, ErrBreakerOpen
+}
+
+// pipeline 中任一请求无法降级时整体返回 ErrBreakerOpen
+func (this *Breaker) DegradeMulti(msgList []*protocol.Msg) ([]*protocol.Msg, error) {
+	replies := make([]*protocol.Msg, len(msgList))
+	for i, msg := range msgList {
+		reply, err := this.Degrade(msg)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
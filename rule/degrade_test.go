@@ -0,0 +1,149 @@
+package rule
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"ncache/config"
+	"ncache/protocol"
+	"ncache/stat"
+	"ncache/utils"
+)
+
+func allow(breaker *Breaker) bool {
+	_, ok := breaker.Allow()
+	return ok
+}
+
+func TestBreaker(t *testing.T) {
+	breaker, err := NewBreaker("127.0.0.1:6379", &config.DegradeConf{
+		MinRequests:      4,
+		ErrorRate:        0.5,
+		HalfOpenRequests: 2,
+		ReadAction:       "nil",
+	})
+	utils.AssertMustNoError(err)
+	defer breaker.Close()
+	errBackend := errors.New("backend err")
+	for i := 0; i < 4; i++ {
+		generation, ok := breaker.Allow()
+		utils.AssertMust(ok)
+		if i%2 == 0 {
+			breaker.Done(generation, errBackend, 0)
+		} else {
+			breaker.Done(generation, nil, 0)
+		}
+	}
+	utils.AssertMust(breaker.State() == BreakerOpen && !allow(breaker))
+	utils.AssertMust(stat.Snapshot()["breaker_state_127.0.0.1_6379"] == BreakerOpen)
+
+	reply, err := breaker.Degrade(protocol.NewCmdMsg("GET a"))
+	utils.AssertMust(err == nil && reply == protocol.NullBulkString)
+	_, err = breaker.Degrade(protocol.NewCmdMsg("SET a 1"))
+	utils.AssertMust(err == ErrBreakerOpen)
+	// 降级响应的类型与原命令一致
+	reply, err = breaker.Degrade(protocol.NewCmdMsg("MGET a b"))
+	utils.AssertMust(err == nil && reply.GetArrayLen() == 2 && protocol.IsNilMsg(reply.GetArray()[1]))
+	reply, err = breaker.Degrade(protocol.NewCmdMsg("HGETALL a"))
+	utils.AssertMust(err == nil && reply.IsArray() && reply.GetArrayLen() == 0)
+	reply, err = breaker.Degrade(protocol.NewCmdMsg("EXISTS a"))
+	utils.AssertMust(err == nil && reply.IsInt() && reply.GetInt() == 0)
+	reply, err = breaker.Degrade(protocol.NewCmdMsg("TTL a"))
+	utils.AssertMust(err == nil && reply.GetInt() == -2)
+	_, err = breaker.Degrade(protocol.NewCmdMsg("ZRANGEBYLEX a - +"))
+	utils.AssertMust(err == ErrBreakerOpen)
+
+	// 半开状态下只放行 2 个探测请求, 全部成功后恢复
+	breaker.openTime = 0
+	generation, ok := breaker.Allow()
+	utils.AssertMust(ok && allow(breaker) && !allow(breaker))
+	utils.AssertMust(breaker.State() == BreakerHalfOpen)
+	breaker.Done(generation, nil, 0)
+	breaker.Done(generation, nil, 0)
+	utils.AssertMust(breaker.State() == BreakerClosed)
+
+	// 探测失败时重新熔断
+	breaker.trip()
+	generation, ok = breaker.Allow()
+	utils.AssertMust(ok)
+	breaker.Done(generation, errBackend, time.Millisecond)
+	utils.AssertMust(breaker.State() == BreakerOpen)
+
+	var nilBreaker *Breaker
+	utils.AssertMust(allow(nilBreaker) && nilBreaker.State() == BreakerClosed)
+	_, err = NewBreaker("127.0.0.1:6380", &config.DegradeConf{WriteAction: "nil"})
+	utils.AssertMust(err != nil)
+}
+
+func TestBreakerSlow(t *testing.T) {
+	breaker, err := NewBreaker("127.0.0.1:6381", &config.DegradeConf{
+		MinRequests:   2,
+		SlowRate:      1,
+		SlowThreshold: 10,
+		WriteAction:   "ok",
+	})
+	utils.AssertMustNoError(err)
+	defer breaker.Close()
+	breaker.Done(0, nil, 20*time.Millisecond)
+	utils.AssertMust(breaker.State() == BreakerClosed)
+	breaker.Done(0, nil, 20*time.Millisecond)
+	utils.AssertMust(breaker.State() == BreakerOpen)
+	replies, err := breaker.DegradeMulti([]*protocol.Msg{protocol.NewCmdMsg("SET a 1"), protocol.NewCmdMsg("MSET a 1 b 2")})
+	utils.AssertMust(err == nil && len(replies) == 2 && protocol.IsOkMsg(replies[1]))
+	_, err = breaker.DegradeMulti([]*protocol.Msg{protocol.NewCmdMsg("SET a 1"), protocol.NewCmdMsg("GET a")})
+	utils.AssertMust(err == ErrBreakerOpen)
+	// 响应为整数或旧值的写命令不能以 OK 代替
+	for _, cmd := range []string{"DEL a", "INCR a", "LPUSH a 1", "HSET a f 1", "EXPIRE a 1", "SET a 1 GET"} {
+		_, err = breaker.Degrade(protocol.NewCmdMsg(cmd))
+		utils.AssertMust(err == ErrBreakerOpen)
+	}
+}
+
+func TestBreakerStaleDone(t *testing.T) {
+	breaker, err := NewBreaker("stale_127.0.0.1_6379", &config.DegradeConf{
+		MinRequests:      1,
+		ErrorRate:        1,
+		HalfOpenRequests: 1,
+		ReadAction:       "nil",
+	})
+	utils.AssertMustNoError(err)
+	defer breaker.Close()
+	// 熔断前放行的慢请求在半开状态下结束, 不能当作探测请求
+	stale, ok := breaker.Allow()
+	utils.AssertMust(ok)
+	breaker.trip()
+	breaker.openTime = 0
+	probe, ok := breaker.Allow()
+	utils.AssertMust(ok && probe != stale && breaker.State() == BreakerHalfOpen)
+	breaker.Done(stale, nil, 0)
+	utils.AssertMust(breaker.State() == BreakerHalfOpen)
+	breaker.Done(stale, errors.New("backend err"), 0)
+	utils.AssertMust(breaker.State() == BreakerHalfOpen)
+	breaker.Done(probe, nil, 0)
+	utils.AssertMust(breaker.State() == BreakerClosed)
+}
+
+func TestBreakerInfo(t *testing.T) {
+	conf := &config.DegradeConf{MinRequests: 1, ErrorRate: 1, ReadAction: "nil"}
+	// 同一节点配置在不同 backend 中时分别统计
+	feed, err := NewBreaker("feed_127.0.0.1_6390", conf)
+	utils.AssertMustNoError(err)
+	defer feed.Close()
+	user, err := NewBreaker("user_127.0.0.1_6390", conf)
+	utils.AssertMustNoError(err)
+	defer user.Close()
+	feed.trip()
+	info := breakerInfo()
+	utils.AssertMust(info["breaker_state_feed_127.0.0.1_6390"] == BreakerOpen)
+	utils.AssertMust(info["breaker_state_user_127.0.0.1_6390"] == BreakerClosed)
+
+	// 重新加载时新的熔断器替换旧的, 旧的注销不影响新的
+	newFeed, err := NewBreaker("feed_127.0.0.1_6390", conf)
+	utils.AssertMustNoError(err)
+	defer newFeed.Close()
+	utils.AssertMust(breakerInfo()["breaker_state_feed_127.0.0.1_6390"] == BreakerClosed)
+	feed.Close()
+	newFeed.trip()
+	utils.AssertMust(breakerInfo()["breaker_state_feed_127.0.0.1_6390"] == BreakerOpen)
+}
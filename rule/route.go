@@ -1 +1,151 @@
 package rule
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"ncache/config"
+	"ncache/filter"
+)
+
+// 路由规则类型
+const (
+	RoutePrefix  = "prefix"  // key 以 pattern 开头
+	RouteGlob    = "glob"    // key 完整匹配 glob
+	RouteRegex   = "regex"   // key 匹配正则, backend 中可使用 $1 等引用分组
+	RouteHashTag = "hashtag" // key 中 {} 之间的内容, backend 为空时以其作为 backend 名
+	RouteCommand = "command" // 按命令路由, 不检查 key
+)
+
+var routeTable atomic.Value
+
+func init() {
+	routeTable.Store(&RouteTable{})
+}
+
+type routeRule struct {
+	kind    string
+	pattern string
+	backend string
+	// glob 及 regex 规则使用
+	re   *regexp.Regexp
+	cmds map[string]bool
+}
+
+// 按 key 判断是否匹配, 匹配时返回 backend 名
+func (this *routeRule) match(cmd, key string) (string, bool) {
+	switch this.kind {
+	case RoutePrefix:
+		return this.backend, strings.HasPrefix(key, this.pattern)
+	case RouteGlob:
+		return this.backend, this.re.MatchString(key)
+	case RouteRegex:
+		match := this.re.FindStringSubmatchIndex(key)
+		if match == nil {
+			return "", false
+		}
+		return string(this.re.ExpandString(nil, this.backend, key, match)), true
+	case RouteHashTag:
+		start := strings.IndexByte(key, '{')
+		if start == -1 {
+			return "", false
+		}
+		end := strings.IndexByte(key[start+1:], '}')
+		if end <= 0 {
+			return "", false
+		}
+		if this.backend != "" {
+			return this.backend, true
+		}
+		return strings.ToLower(key[start+1 : start+1+end]), true
+	case RouteCommand:
+		return this.backend, this.cmds[cmd]
+	}
+	return "", false
+}
+
+func (this *routeRule) String() string {
+	return fmt.Sprintf("%s '%s' -> %s", this.kind, this.pattern, this.backend)
+}
+
+// 按配置顺序匹配的路由规则, 第一个匹配的规则生效
+type RouteTable struct {
+	rules []*routeRule
+}
+
+func NewRouteTable(confs []config.RouteRuleConf) (*RouteTable, error) {
+	table := &RouteTable{rules: make([]*routeRule, 0, len(confs))}
+	for i, conf := range confs {
+		r := &routeRule{kind: strings.ToLower(conf.Type), pattern: conf.Pattern, backend: conf.Backend}
+		var err error
+		switch r.kind {
+		case RoutePrefix:
+			if r.pattern == "" || r.backend == "" {
+				err = fmt.Errorf("pattern and backend are required")
+			}
+		case RouteGlob:
+			if r.backend == "" {
+				err = fmt.Errorf("backend is required")
+			} else {
+				r.re, err = filter.CompileGlob(r.pattern)
+			}
+		case RouteRegex:
+			if r.backend == "" {
+				err = fmt.Errorf("backend is required")
+			} else {
+				r.re, err = regexp.Compile(r.pattern)
+			}
+		case RouteHashTag:
+		case RouteCommand:
+			if len(conf.Commands) == 0 || r.backend == "" {
+				err = fmt.Errorf("commands and backend are required")
+			}
+			// 命令规则的 pattern 只用于 Explain 显示
+			r.pattern = strings.ToUpper(strings.Join(conf.Commands, ","))
+			r.cmds = make(map[string]bool, len(conf.Commands))
+			for _, cmd := range conf.Commands {
+				r.cmds[strings.ToUpper(cmd)] = true
+			}
+		default:
+			err = fmt.Errorf("unknown type %s", conf.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Rule: route rule %d: %s", i+1, err)
+		}
+		table.rules = append(table.rules, r)
+	}
+	return table, nil
+}
+
+// 没有匹配的规则时 ok 为 false
+func (this *RouteTable) Resolve(cmd, key string) (backend string, ok bool) {
+	for _, r := range this.rules {
+		if backend, ok = r.match(cmd, key); ok {
+			return
+		}
+	}
+	return "", false
+}
+
+// 逐条列出规则的匹配结果, 直到第一个匹配的规则
+func (this *RouteTable) Explain(cmd, key string) []string {
+	lines := make([]string, 0, len(this.rules))
+	for i, r := range this.rules {
+		if backend, ok := r.match(cmd, key); ok {
+			return append(lines, fmt.Sprintf("rule %d %s: match, backend %s", i+1, r, backend))
+		}
+		lines = append(lines, fmt.Sprintf("rule %d %s: no match", i+1, r))
+	}
+	return lines
+}
+
+// 重新加载配置时整体替换
+func SetRouteTable(table *RouteTable) {
+	routeTable.Store(table)
+}
+
+func GetRouteTable() *RouteTable {
+	return routeTable.Load().(*RouteTable)
+}
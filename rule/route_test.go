@@ -0,0 +1,51 @@
+package rule
+
+import (
+	"strings"
+	"testing"
+
+	"ncache/config"
+	"ncache/utils"
+)
+
+func TestRouteTable(t *testing.T) {
+	table, err := NewRouteTable([]config.RouteRuleConf{
+		{Type: "command", Commands: []string{"publish"}, Backend: "pubsub"},
+		{Type: "prefix", Pattern: "sess_", Backend: "session"},
+		{Type: "glob", Pattern: "u[0-9]*", Backend: "user"},
+		{Type: "regex", Pattern: `^(\w+)\.`, Backend: "ns_$1"},
+		{Type: "hashtag"},
+	})
+	utils.AssertMustNoError(err)
+	cases := []struct {
+		cmd, key, backend string
+	}{
+		{"PUBLISH", "sess_1", "pubsub"},
+		{"GET", "sess_1", "session"},
+		{"GET", "u1:name", "user"},
+		{"GET", "feed.1", "ns_feed"},
+		{"GET", "x{Feed}1", "feed"},
+	}
+	for _, c := range cases {
+		backend, ok := table.Resolve(c.cmd, c.key)
+		utils.AssertMust(ok && backend == c.backend)
+	}
+	_, ok := table.Resolve("GET", "feed:1")
+	utils.AssertMust(!ok)
+	_, ok = table.Resolve("GET", "x{}1")
+	utils.AssertMust(!ok)
+
+	lines := table.Explain("GET", "u1")
+	utils.AssertMust(len(lines) == 3 && strings.HasSuffix(lines[2], "match, backend user"))
+	utils.AssertMust(strings.HasSuffix(lines[0], "no match"))
+
+	for _, conf := range []config.RouteRuleConf{
+		{Type: "prefix", Pattern: "a"},
+		{Type: "regex", Pattern: "(", Backend: "a"},
+		{Type: "command", Backend: "a"},
+		{Type: "unknown"},
+	} {
+		_, err = NewRouteTable([]config.RouteRuleConf{conf})
+		utils.AssertMust(err != nil)
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"ncache/backend/route"
+	"ncache/config"
+	"ncache/protocol"
+	"ncache/stat"
+)
+
+// NCACHE <subcommand> [arg ...], 代理自身的管理命令
+func (this *Client) procNcache() *protocol.Msg {
+	if this.argc < 2 {
+		return protocol.NewErrorMsgFmt("ERR wrong number of arguments for '%s' command", this.curCmd)
+	}
+	subCmd := strings.ToUpper(this.args[1])
+	switch subCmd {
+	case "RELOAD":
+		// NCACHE RELOAD [file], 不指定文件时重新加载当前的 db 配置文件.
+		// file 只能是当前 db 配置文件所在目录下的文件名
+		if this.argc > 3 {
+			return protocol.NewErrorMsgFmt("ERR wrong number of arguments for '%s %s' command", this.curCmd, subCmd)
+		}
+		var file string
+		if this.argc == 3 {
+			name := this.args[2]
+			if name != filepath.Base(name) || name == "." || name == ".." {
+				return protocol.NewErrorMsg("ERR reload file must be a file name in the config directory")
+			}
+			file = filepath.Join(filepath.Dir(config.GetDbConfPath()), name)
+		}
+		if err := this.Server.Reload(file); err != nil {
+			return protocol.NewErrorMsgFmt("ERR reload failed: %s", err)
+		}
+		return protocol.MsgOK
+	case "STATS":
+		return procStats()
+	case "BLOCKKEY":
+		return this.procBlockKey()
+	case "MIGRATE":
+		// NCACHE MIGRATE backend [phase], 不指定阶段时返回当前阶段
+		if this.argc < 3 || this.argc > 4 {
+			return protocol.NewErrorMsgFmt("ERR wrong number of arguments for '%s %s' command", this.curCmd, subCmd)
+		}
+		if this.argc == 3 {
+			phase, err := route.GetMigratePhase(this.args[2])
+			if err != nil {
+				return protocol.NewErrorMsg("ERR " + err.Error())
+			}
+			return protocol.NewBulkStringMsg([]byte(phase))
+		}
+		if err := route.SetMigratePhase(this.args[2], this.args[3]); err != nil {
+			return protocol.NewErrorMsg("ERR " + err.Error())
+		}
+		return protocol.MsgOK
+	case "EXPLAIN":
+		// NCACHE EXPLAIN key [command], 显示 key 的路由过程
+		if this.argc < 3 || this.argc > 4 {
+			return protocol.NewErrorMsgFmt("ERR wrong number of arguments for '%s %s' command", this.curCmd, subCmd)
+		}
+		var cmd string
+		if this.argc == 4 {
+			cmd = strings.ToUpper(this.args[3])
+		}
+		return protocol.NewArrayMsgFormStrings(route.Explain(cmd, this.args[2]))
+	case "REBALANCE":
+		// NCACHE REBALANCE backend, 显示重新分片的进度
+		if this.argc != 3 {
+			return protocol.NewErrorMsgFmt("ERR wrong number of arguments for '%s %s' command", this.curCmd, subCmd)
+		}
+		return procRebalance(this.args[2])
+	}
+	return protocol.NewErrorMsgFmt("ERR unknown subcommand '%s'", this.args[1])
+}
+
+// 与 INFO 格式一致, 每行一项 name:value
+func procStats() *protocol.Msg {
+	snapshot := stat.Snapshot()
+	names := make([]string, 0, len(snapshot))
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		buf.WriteString(name)
+		buf.WriteByte(':')
+		buf.WriteString(strconv.FormatInt(snapshot[name], 10))
+		buf.WriteString("\r\n")
+	}
+	return protocol.NewBulkStringMsg(buf.Bytes())
+}
+
+// 格式与 STATS 一致, node 为正在扫描的旧节点下标
+func procRebalance(name string) *protocol.Msg {
+	progress, err := route.GetRebalanceProgress(name)
+	if err != nil {
+		return protocol.NewErrorMsg("ERR " + err.Error())
+	}
+	done := 0
+	if progress.Done {
+		done = 1
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "scanned:%d\r\n", progress.Scanned)
+	fmt.Fprintf(&buf, "moved:%d\r\n", progress.Moved)
+	fmt.Fprintf(&buf, "failed:%d\r\n", progress.Failed)
+	fmt.Fprintf(&buf, "node:%d\r\n", progress.Node)
+	fmt.Fprintf(&buf, "nodes:%d\r\n", progress.Nodes)
+	fmt.Fprintf(&buf, "done:%d\r\n", done)
+	return protocol.NewBulkStringMsg(buf.Bytes())
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"ncache/config"
+	"ncache/filter"
+	"ncache/protocol"
+)
+
+const (
+	tlsHandshakeTimeout = 5 * time.Second
+
+	errWrongPass = "WRONGPASS invalid username-password pair or user is disabled."
+	errNoAuth    = "NOAUTH Authentication required."
+)
+
+// 初始化认证用户, 用户名为空时为默认用户
+func (this *Server) initUsers(confs []config.UserConf) error {
+	if len(confs) == 0 {
+		return nil
+	}
+	this.users = make(map[string][]byte, len(confs))
+	this.acls = make(map[string]*filter.Acl)
+	this.certUsers = make(map[string]string)
+	for _, conf := range confs {
+		name := conf.Name
+		if name == "" {
+			name = defaultUser
+		}
+		if _, ok := this.users[name]; ok {
+			return fmt.Errorf("Server: user %s defined twice", name)
+		}
+		// 只通过证书认证的用户没有密码
+		var hash []byte
+		if conf.Pass != "" || conf.CertCn == "" {
+			var err error
+			if hash, err = hex.DecodeString(conf.Pass); err != nil || len(hash) != sha256.Size {
+				return fmt.Errorf("Server: user %s: pass must be a hex encoded sha256 hash", name)
+			}
+		}
+		if conf.CertCn != "" {
+			if _, ok := this.certUsers[conf.CertCn]; ok {
+				return fmt.Errorf("Server: cert cn %s used by more than one user", conf.CertCn)
+			}
+			this.certUsers[conf.CertCn] = name
+		}
+		this.users[name] = hash
+		if conf.Acl != nil {
+			this.acls[name] = filter.NewAcl(conf.Acl.Read, conf.Acl.Write, conf.Acl.Admin)
+		}
+	}
+	return nil
+}
+
+// 配置了用户时需要认证
+func (this *Server) authRequired() bool {
+	return len(this.users) > 0
+}
+
+// 未开启认证时, 与 redis 的 nopass 默认用户行为一致, 只接受默认用户
+func (this *Server) checkPass(user, pass string) bool {
+	if !this.authRequired() {
+		return user == defaultUser
+	}
+	hash, ok := this.users[user]
+	sum := sha256.Sum256([]byte(pass))
+	return ok && hash != nil && subtle.ConstantTimeCompare(hash, sum[:]) == 1
+}
+
+// 未认证时可以执行的命令
+func isNoAuthCmd(cmd string) bool {
+	return cmd == "AUTH" || cmd == "PING" || cmd == "HELLO"
+}
+
+// AUTH [username] password
+func (this *Client) procAuth() *protocol.Msg {
+	var user, pass string
+	switch this.argc {
+	case 2:
+		user, pass = defaultUser, this.args[1]
+	case 3:
+		user, pass = this.args[1], this.args[2]
+	default:
+		return protocol.NewErrorMsgFmt("ERR wrong number of arguments for '%s' command", this.curCmd)
+	}
+	if !this.Server.authRequired() && this.argc == 2 {
+		return protocol.NewErrorMsg("ERR AUTH <password> called without any password configured for the default user. " +
+			"Are you sure your configuration is correct?")
+	}
+	if !this.Server.checkPass(user, pass) {
+		return protocol.NewErrorMsg(errWrongPass)
+	}
+	this.setUser(user)
+	return protocol.MsgOK
+}
+
+func (this *Client) setUser(user string) {
+	this.user, this.authed = user, true
+	this.acl = this.Server.acls[user]
+}
+
+// TLS 连接在处理请求前完成握手, 客户端证书的 CN 与用户匹配时自动认证
+func (this *Client) tlsHandshake() error {
+	tlsConn, ok := this.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		this.certSubject = certs[0].Subject.String()
+		if user, ok := this.Server.certUsers[certs[0].Subject.CommonName]; ok {
+			this.setUser(user)
+		}
+	}
+	return nil
+}
+
+// 检查当前用户的权限, 无权限时返回错误响应. 请求中的 key 均按转发的 backend (index) 检查
+func (this *Client) checkAcl(index string) *protocol.Msg {
+	if this.acl == nil {
+		return nil
+	}
+	cmdOk, keyOk := this.acl.Check(this.curCmd, this.args, backendPrefix(index))
+	if !cmdOk {
+		return protocol.NewErrorMsgFmt("NOPERM this user has no permissions to run the '%s' command",
+			strings.ToLower(this.curCmd))
+	}
+	if !keyOk {
+		return protocol.NewErrorMsg("NOPERM this user has no permissions to access one of the keys used as arguments")
+	}
+	return nil
+}
+
+// 请求的所有 key 都转发到同一 backend, acl 及 key 规则中的前缀即 backend 名
+func backendPrefix(index string) func(string) string {
+	return func(string) string {
+		return index
+	}
+}
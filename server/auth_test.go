@@ -0,0 +1,76 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"ncache/config"
+	"ncache/filter"
+	"ncache/protocol"
+	"ncache/rule"
+	"ncache/utils"
+)
+
+func newAuthTestClient(t *testing.T) *Client {
+	sum := sha256.Sum256([]byte("secret"))
+	server := &Server{}
+	utils.AssertMustNoError(server.initUsers([]config.UserConf{
+		{Pass: hex.EncodeToString(sum[:])},
+		{Name: "alice", Pass: hex.EncodeToString(sum[:])},
+	}))
+	return &Client{Server: server, protoVer: protoVerResp2}
+}
+
+func parseTestCmd(client *Client, cmd string) *protocol.Msg {
+	client.reqState = reqState{curReq: protocol.NewCmdMsg(cmd), stage: processParse}
+	utils.AssertMustNoError(client.CmdParse())
+	return client.response
+}
+
+func TestAuth(t *testing.T) {
+	client := newAuthTestClient(t)
+	msg := parseTestCmd(client, "GET a")
+	str, _ := msg.GetError()
+	utils.AssertMust(str == errNoAuth)
+	utils.AssertMust(parseTestCmd(client, "PING") == protocol.MsgPONG)
+
+	str, _ = parseTestCmd(client, "AUTH wrong").GetError()
+	utils.AssertMust(str == errWrongPass)
+	utils.AssertMust(protocol.IsOkMsg(parseTestCmd(client, "AUTH secret")))
+	utils.AssertMust(client.authed && client.user == defaultUser)
+
+	client = newAuthTestClient(t)
+	utils.AssertMust(protocol.IsOkMsg(parseTestCmd(client, "AUTH alice secret")))
+	utils.AssertMust(client.user == "alice")
+	parseTestCmd(client, "GET a")
+	utils.AssertMust(client.stage == processRoute)
+}
+
+func TestInitUsers(t *testing.T) {
+	server := &Server{}
+	utils.AssertMust(server.initUsers([]config.UserConf{{Name: "a", Pass: "secret"}}) != nil)
+	utils.AssertMustNoError(server.initUsers(nil))
+	utils.AssertMust(!server.authRequired())
+	utils.AssertMust(server.checkPass(defaultUser, "any"))
+}
+
+// 权限按请求实际转发的 backend 检查, 包括命令路由规则及 listener 绑定的 backend
+func TestAclRouteIndex(t *testing.T) {
+	table, err := rule.NewRouteTable([]config.RouteRuleConf{{Type: rule.RouteCommand, Commands: []string{"set"}, Backend: "pubsub"}})
+	utils.AssertMustNoError(err)
+	rule.SetRouteTable(table)
+	defer rule.SetRouteTable(&rule.RouteTable{})
+
+	client := &Client{Server: &Server{}, protoVer: protoVerResp2}
+	client.acl = filter.NewAcl([]string{"public"}, []string{"public"}, false)
+	parseTestCmd(client, "GET public:a")
+	utils.AssertMust(client.stage == processRoute)
+	str, _ := parseTestCmd(client, "SET public:a 1").GetError()
+	utils.AssertMust(strings.HasPrefix(str, "NOPERM"))
+
+	client.listener = &listener{backend: "payments"}
+	str, _ = parseTestCmd(client, "GET public:a").GetError()
+	utils.AssertMust(strings.HasPrefix(str, "NOPERM"))
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -15,6 +16,7 @@ import (
 	"ncache/backend/route"
 	"ncache/filter"
 	"ncache/protocol"
+	"ncache/stat"
 	"ncache/utils"
 	"runtime/debug"
 )
@@ -25,6 +27,16 @@ type ProcessStage int
 const (
 	defaultReadBufferSize  = 512
 	defaultWriteBufferSize = 512
+
+	protoVerResp2 = 2
+	protoVerResp3 = 3
+
+	// 一次从缓冲区中批量读取的最大请求数
+	maxPipelineSize = 256
+
+	clientIdle    = 0
+	clientBusy    = 1
+	clientClosing = 2
 )
 const (
 	processReceive ProcessStage = iota
@@ -35,9 +47,12 @@ const (
 )
 
 var (
-	errClientClosed   = errors.New("Server: client closed")
-	errInvalidRequest = errors.New("Server: Invalid request")
-	errNoDbSpecified  = errors.New("Server: No DB specified")
+	errClientClosed      = errors.New("Server: client closed")
+	errInvalidRequest    = errors.New("Server: Invalid request")
+	errNoDbSpecified     = errors.New("Server: No DB specified")
+	errEmptyBackendReply = errors.New("Server: empty backend reply")
+	errServerStopped     = errors.New("Server: server has stopped")
+	errRequestTimeout    = errors.New("request timeout")
 )
 
 var (
@@ -52,72 +67,175 @@ func newClientId() uint64 {
 	return atomic.AddUint64(&clientSeq, uint64(1))
 }
 
+// 单个请求的处理状态, pipeline 中每个请求各保存一份
+type reqState struct {
+	curCmd string
+	curReq *protocol.Msg
+	args   []string
+	argc   int
+
+	backend  backend.Backend
+	response *protocol.Msg
+	// 批量处理时后端返回的错误
+	procErr error
+
+	start time.Time
+	stage ProcessStage
+	// 响应使用的协议版本, 读取请求时确定, 不受 pipeline 中之后的 HELLO 影响
+	respVer int
+}
+
 type Client struct {
 	id   uint64
 	addr string
+	ip   string
+	name string
+	// 认证的用户及其访问权限
+	user string
+	acl  *filter.Acl
 	conn net.Conn
 	br   *bufio.Reader
 	bw   *bufio.Writer
+	// TLS 客户端证书的 subject
+	certSubject string
 
 	Server *Server
+	// 客户端连接的监听
+	listener *listener
+
+	reqState
+	// 已读取待处理的请求
+	pipeline []reqState
 
-	backend  backend.Backend
 	beCache  map[string]backend.Backend
 	curIndex string
-
-	stage ProcessStage
+	// backend 重新加载后, 缓存的 backend 失效
+	beVersion uint64
 
 	transReqList []*protocol.Msg
 	transStart   time.Time
 
-	curCmd string
-	curReq *protocol.Msg
-	args   []string
-	argc   int
-
-	response *protocol.Msg
-
-	closed          bool
+	closed          int32
 	lastinteraction int64
+	// 进入当前处理阶段的时间, 用于定时任务检查卡住的客户端
+	stageTime int64
+	// 是否有正在处理的请求, 关闭服务时只能直接关闭空闲的客户端
+	busy int32
 
-	start time.Time
+	// 客户端协议版本, 通过 HELLO 协商
+	protoVer int
+	authed   bool
 }
 
 func NewClient(server *Server, conn net.Conn) (client *Client, err error) {
 	if !server.IsStop() {
 		client = &Client{
-			id:      newClientId(),
-			Server:  server,
-			conn:    conn,
-			br:      bufio.NewReaderSize(conn, defaultReadBufferSize),
-			bw:      bufio.NewWriterSize(conn, defaultWriteBufferSize),
-			beCache: make(map[string]backend.Backend),
-			addr:    utils.RemoteAddr(conn),
-			closed:  false,
+			id:        newClientId(),
+			Server:    server,
+			conn:      conn,
+			br:        bufio.NewReaderSize(conn, defaultReadBufferSize),
+			bw:        bufio.NewWriterSize(conn, defaultWriteBufferSize),
+			beCache:   make(map[string]backend.Backend),
+			beVersion: route.GetVersion(),
+			addr:      utils.RemoteAddr(conn),
+			ip:        utils.RemoteIp(conn),
+			protoVer:  protoVerResp2,
+
+			lastinteraction: utils.UnixTime(),
 		}
 	} else {
-		err = errors.New("server has stopped")
+		err = errServerStopped
 	}
 	return
 }
 
 //todo:
 func (this *Client) Close() {
-	if this.IsClosed() {
+	if !atomic.CompareAndSwapInt32(&this.closed, 0, 1) {
 		return
 	}
-	this.closed = true
 	this.conn.Close()
 	return
 }
 
 func (this *Client) IsClosed() bool {
-	return this.closed
+	return atomic.LoadInt32(&this.closed) == 1
+}
+
+// 以下供插件获取当前请求的信息
+func (this *Client) GetId() uint64 {
+	return this.id
+}
+
+func (this *Client) GetAddr() string {
+	return this.addr
+}
+
+func (this *Client) GetCmd() string {
+	return this.curCmd
+}
+
+func (this *Client) GetArgs() []string {
+	return this.args
+}
+
+func (this *Client) GetResponse() *protocol.Msg {
+	return this.response
+}
+
+func (this *Client) GetUser() string {
+	return this.user
+}
+
+// 未使用 TLS 或客户端未提供证书时为空
+func (this *Client) GetCertSubject() string {
+	return this.certSubject
+}
+
+// 读取到请求后标记为忙碌, 已被关闭服务标记时返回 false, 请求不再处理
+func (this *Client) setBusy() bool {
+	if !atomic.CompareAndSwapInt32(&this.busy, clientIdle, clientBusy) {
+		return false
+	}
+	this.setStageTime()
+	return true
+}
+
+func (this *Client) setStageTime() {
+	atomic.StoreInt64(&this.stageTime, utils.UnixTime())
+}
+
+// 有正在处理的请求, 且停留在当前阶段超过 timeout 秒
+func (this *Client) isStageTimeout(now, timeout int64) bool {
+	return atomic.LoadInt32(&this.busy) == clientBusy && now-atomic.LoadInt64(&this.stageTime) > timeout
+}
+
+func (this *Client) setIdle() {
+	atomic.StoreInt32(&this.busy, clientIdle)
+}
+
+// 客户端空闲时关闭, 阻塞在读取请求上的客户端可以安全关闭
+func (this *Client) closeIfIdle() bool {
+	if atomic.CompareAndSwapInt32(&this.busy, clientIdle, clientClosing) {
+		this.Close()
+		return true
+	}
+	return false
 }
 
 func (this *Client) IsIdle(idle int64) bool {
 	now := utils.UnixTime()
-	return now-this.lastinteraction > idle
+	return now-atomic.LoadInt64(&this.lastinteraction) > idle
+}
+
+// 切面通过 Reply 提前返回响应时, 跳过后续处理阶段
+func (this *Client) aspectReply(err error) error {
+	if reply, ok := err.(*replyError); ok {
+		this.response = reply.msg
+		this.stage = processResponse
+		return nil
+	}
+	return err
 }
 
 func printElapse(stage string, start time.Time) {
@@ -129,11 +247,12 @@ func (this *Client) CmdReceive() (err error) {
 	//fmt.Println("CmdReceive")
 	this.start = time.Now()
 	defer func() {
-		this.lastinteraction = utils.UnixTime()
+		atomic.StoreInt64(&this.lastinteraction, utils.UnixTime())
 	}()
 	var msg *protocol.Msg
-	if msg, err = protocol.NewMsgFromReader(this.br); err != nil {
-		if err != io.EOF {
+	if msg, err = protocol.NewRequestFromReader(this.br); err != nil {
+		// 协议错误需返回给客户端, 在之前的请求响应之后写入
+		if err != io.EOF && !protocol.IsProtocolError(err) {
 			err = fmt.Errorf("read request: %s", err)
 		}
 		return
@@ -142,8 +261,13 @@ func (this *Client) CmdReceive() (err error) {
 		err = errInvalidRequest
 		return
 	}
-	this.curReq = msg
-	this.stage = processParse
+	this.reqState = reqState{
+		curReq:  msg,
+		backend: this.backend,
+		start:   this.start,
+		stage:   processParse,
+		respVer: this.protoVer,
+	}
 	log.Debugf("Request:\n%s", this.curReq)
 	return
 }
@@ -166,16 +290,70 @@ func (this *Client) CmdParse() (err error) {
 		log.Warningf("Unsurport commnad %s", this.curCmd)
 		return
 	}
-	if this.curCmd == "PING" {
-		this.response = protocol.MsgPONG
+	this.argc = len(args)
+	if !this.listener.isCmdAllowed(this.curCmd) {
+		this.response = protocol.NewErrorMsgFmt("ERR command '%s' is not allowed on this listener", this.curCmd)
+		this.stage = processResponse
+		return
+	}
+	if !this.authed && this.Server.authRequired() && !isNoAuthCmd(this.curCmd) {
+		this.response = protocol.NewErrorMsg(errNoAuth)
+		this.stage = processResponse
+		return
+	}
+	if filter.IsProxyAdminCmd(this.curCmd) && !this.Server.adminEnable {
+		this.response = protocol.NewErrorMsg("ERR admin commands are disabled, set admin_enable to enable them")
+		this.stage = processResponse
+		return
+	}
+	// 权限及 key 规则按请求实际转发的 backend 检查, 与 NodeRoute 一致
+	var index string
+	if this.argc > 1 {
+		index = this.routeIndex()
+	}
+	if msg := this.checkAcl(index); msg != nil {
+		this.response = msg
+		this.stage = processResponse
+		return
+	}
+	if msg := this.checkKeys(index); msg != nil {
+		this.response = msg
+		this.stage = processResponse
+		return
+	}
+	if filter.IsLocalCmd(this.curCmd) || filter.IsProxyAdminCmd(this.curCmd) {
+		this.response = this.procLocalCmd()
+		this.stage = processResponse
+		return
+	}
+	if msg := this.checkBackendCmd(index); msg != nil {
+		this.response = msg
 		this.stage = processResponse
 		return
 	}
-	this.argc = len(args)
 	this.stage = processRoute
 	return
 }
 
+// 按第一个 key 的前缀选择 backend, listener 绑定了 backend 时使用该 backend
+func (this *Client) routeIndex() string {
+	if this.listener != nil && this.listener.backend != "" {
+		return this.listener.backend
+	}
+	return route.GetIndexByCmd(this.curCmd, this.args[1])
+}
+
+// 在解析阶段拒绝 backend 不允许执行的命令, index 为请求转发的 backend
+func (this *Client) checkBackendCmd(index string) *protocol.Msg {
+	if this.argc < 2 {
+		return nil
+	}
+	if !route.IsCmdAllowed(index, this.curCmd) {
+		return protocol.NewErrorMsgFmt("ERR command '%s' is not allowed on backend '%s'", strings.ToLower(this.curCmd), index)
+	}
+	return nil
+}
+
 //todo:
 func (this *Client) NodeRoute() (err error) {
 	//fmt.Println("NodeRoute")
@@ -191,9 +369,14 @@ func (this *Client) NodeRoute() (err error) {
 		this.stage = processBackend
 	}()
 
-	mainKey := this.args[1]
-	index := route.GetIndex(mainKey)
+	if version := route.GetVersion(); version != this.beVersion {
+		this.beCache = make(map[string]backend.Backend)
+		this.backend = nil
+		this.curIndex = ""
+		this.beVersion = version
+	}
 
+	index := this.routeIndex()
 	if index == this.curIndex {
 		if this.backend != nil {
 			return
@@ -226,9 +409,115 @@ func (this *Client) BackendProc() (err error) {
 	}
 	defer func() { this.stage = processResponse }()
 	this.response, err = this.backend.Proc(this.curReq)
+	this.response, err = this.checkBackendErr(this.response, err)
 	return err
 }
 
+// 批量处理 pipeline 中需转发的请求, 按 backend 分组并行执行
+func (this *Client) PipelineBackendProc() {
+	this.pipelineBackendProc(this.pipeline)
+}
+
+func (this *Client) pipelineBackendProc(pipeline []reqState) {
+	var (
+		groups  = make(map[backend.Backend][]int)
+		beCount int
+	)
+	for i := range pipeline {
+		if pipeline[i].stage != processBackend {
+			continue
+		}
+		be := pipeline[i].backend
+		if _, ok := groups[be]; !ok {
+			beCount++
+		}
+		groups[be] = append(groups[be], i)
+	}
+	procGroup := func(be backend.Backend, indexes []int) {
+		if len(indexes) == 1 {
+			req := &pipeline[indexes[0]]
+			req.response, req.procErr = be.Proc(req.curReq)
+			req.response, req.procErr = this.checkBackendErr(req.response, req.procErr)
+			req.stage = processResponse
+			return
+		}
+		reqs := make([]*protocol.Msg, len(indexes))
+		for i, index := range indexes {
+			reqs[i] = pipeline[index].curReq
+		}
+		acks, err := be.ProcPipeline(reqs)
+		for i, index := range indexes {
+			req := &pipeline[index]
+			if i < len(acks) && acks[i] != nil {
+				req.response = acks[i]
+			} else {
+				req.response, req.procErr = this.checkBackendErr(nil, err)
+				if req.response == nil && req.procErr == nil {
+					req.procErr = errEmptyBackendReply
+				}
+			}
+			req.stage = processResponse
+		}
+	}
+	if beCount <= 1 {
+		for be, indexes := range groups {
+			procGroup(be, indexes)
+		}
+		return
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(beCount)
+	for be, indexes := range groups {
+		go func(be backend.Backend, indexes []int) {
+			defer wg.Done()
+			procGroup(be, indexes)
+		}(be, indexes)
+	}
+	wg.Wait()
+}
+
+// 在请求的截止时间内完成后端处理, 超时的请求返回超时错误.
+// 超时后后端处理仍在后台继续, 结果被丢弃, 因此只能修改 pipeline 的副本.
+// 后端读写超时不超过请求超时 (见 nodes.SetMaxIoTimeout), 后台处理很快失败并关闭连接, 不会在后端阻塞时不断累积
+func (this *Client) timeoutBackendProc(timeout time.Duration) {
+	// 截止时间从读取到第一个请求开始计算, 包括路由的耗时
+	remain := timeout - time.Now().Sub(this.pipeline[0].start)
+	if remain > 0 {
+		pipeline := make([]reqState, len(this.pipeline))
+		copy(pipeline, this.pipeline)
+		done := make(chan struct{})
+		go func() {
+			this.pipelineBackendProc(pipeline)
+			close(done)
+		}()
+		timer := time.NewTimer(remain)
+		defer timer.Stop()
+		select {
+		case <-done:
+			copy(this.pipeline, pipeline)
+			return
+		case <-timer.C:
+		}
+	}
+	for i := range this.pipeline {
+		if req := &this.pipeline[i]; req.stage == processBackend {
+			log.Warningf("[client][%s] request timeout: %s", this.addr, req.curReq)
+			stat.Incr(statRequestTimeout, 1)
+			req.response = protocol.NewErrorMsg("ERR " + errRequestTimeout.Error())
+			req.stage = processResponse
+		}
+	}
+}
+
+// 后端响应格式错误或超出限制, 仅返回错误, 不关闭客户端连接
+func (this *Client) checkBackendErr(response *protocol.Msg, err error) (*protocol.Msg, error) {
+	if protocol.IsProtocolError(err) {
+		log.Warningf("[client][%s] backend reply err: %s", this.addr, err)
+		return protocol.NewProtocolErrorMsg(err), nil
+	}
+	return response, err
+}
+
 //todo:
 func (this *Client) Response() (err error) {
 	//fmt.Println("Response")
@@ -237,15 +526,19 @@ func (this *Client) Response() (err error) {
 		return
 	}
 	defer func() {
-		this.lastinteraction = utils.UnixTime()
+		atomic.StoreInt64(&this.lastinteraction, utils.UnixTime())
 		this.stage = processReceive
 	}()
 	if this.response == nil {
 		this.response = protocol.NewErrorMsg("Err empty response")
 	}
 	msg := this.response
+	if this.respVer < protoVerResp3 {
+		msg = msg.ToResp2()
+	}
 	//defer protocol.PutMsg(msg)
-	if err = msg.WriteMsg(this.bw); err != nil {
+	// 只写入缓冲区, 由 Flush 统一发送
+	if err = msg.WriteMsgBuffered(this.bw); err != nil {
 		if err != io.EOF {
 			cost := (time.Now().Sub(this.start).Nanoseconds()) / 1000
 			err = fmt.Errorf("request: %s time: %d | response: %s", this.curReq, cost, err)
@@ -256,67 +549,144 @@ func (this *Client) Response() (err error) {
 	return err
 }
 
+// 写响应同样受请求超时限制, 避免阻塞在不读取响应的客户端上
+func (this *Client) Flush() error {
+	if this.bw.Buffered() == 0 {
+		return nil
+	}
+	this.setStageTime()
+	if timeout := this.Server.requestTimeout; timeout > 0 {
+		this.conn.SetWriteDeadline(time.Now().Add(timeout))
+		defer this.conn.SetWriteDeadline(time.Time{})
+	}
+	return this.bw.Flush()
+}
+
+// 读取并预处理缓冲区中已有的请求, 直到缓冲区为空或达到 maxPipelineSize.
+// 出错时已读取的请求仍保留在 pipeline 中, 需先处理完再处理错误
+func (this *Client) receivePipeline() (errTag string, err error) {
+	server := this.Server
+	this.pipeline = this.pipeline[:0]
+	for {
+		if err = this.CmdReceive(); err != nil {
+			return "command receive", err
+		}
+		if len(this.pipeline) == 0 && !this.setBusy() {
+			return "command receive", errServerStopped
+		}
+		if err = server.postCommandReceiveHandler(this); err != nil {
+			return "after command receive", err
+		}
+		if err = this.CmdParse(); err != nil {
+			return "command paser", err
+		}
+		if err = server.postCommandParseHandler(this); err != nil {
+			return "after command parse", err
+		}
+		if err = this.NodeRoute(); err != nil {
+			return "node route", err
+		}
+		if err = server.postNodeRouteHandler(this); err != nil {
+			return "after node route", err
+		}
+		this.pipeline = append(this.pipeline, this.reqState)
+		if this.br.Buffered() == 0 || len(this.pipeline) >= maxPipelineSize {
+			return
+		}
+	}
+}
+
+// 后端处理 pipeline 中的请求, 并按顺序写入响应
+func (this *Client) processPipeline() (errTag string, err error) {
+	server := this.Server
+	if server.requestTimeout > 0 {
+		this.timeoutBackendProc(server.requestTimeout)
+	} else if len(this.pipeline) == 1 {
+		this.reqState = this.pipeline[0]
+		if err = this.BackendProc(); err != nil {
+			return "backend proc", err
+		}
+		this.pipeline[0] = this.reqState
+	} else {
+		this.PipelineBackendProc()
+	}
+	for i := range this.pipeline {
+		this.reqState = this.pipeline[i]
+		if this.procErr != nil {
+			return "backend proc", this.procErr
+		}
+		if err = server.postBackendProcHandler(this); err != nil {
+			return "after backend proc", err
+		}
+		if err = this.Response(); err != nil {
+			return "response", err
+		}
+		if err = server.postFrontResponseHandler(this); err != nil {
+			return "after response", err
+		}
+	}
+	return
+}
+
 func clientHandler(client *Client) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Error("clientHanler panic", r, "stack", string(debug.Stack()))
 		}
 		client.Close()
+		client.Server.removeClient(client)
 	}()
 	server := client.Server
 	var (
 		err    error
 		errTag string
 	)
+	if err = client.tlsHandshake(); err != nil {
+		errTag = "tls handshake"
+		goto errHandle
+	}
 	if err = server.postFrontConnectHandler(client); err != nil {
 		errTag = "after connect"
 		goto errHandle
 	}
 	for {
-		if err = client.CmdReceive(); err != nil {
-			errTag = "command receive"
-			goto errHandle
-		}
-		if err = server.postCommandReceiveHandler(client); err != nil {
-			errTag = "after command receive"
-			goto errHandle
+		var (
+			procErr error
+			procTag string
+		)
+		errTag, err = client.receivePipeline()
+		if len(client.pipeline) > 0 {
+			procTag, procErr = client.processPipeline()
+			if flushErr := client.Flush(); procErr == nil && flushErr != nil {
+				procTag, procErr = "response", flushErr
+			}
 		}
-		if err = client.CmdParse(); err != nil {
-			errTag = "command paser"
-			goto errHandle
-		}
-		if err = server.postCommandParseHandler(client); err != nil {
-			errTag = "after command parse"
-			goto errHandle
+		if procErr != nil {
+			errTag, err = procTag, procErr
 		}
-		if err = client.NodeRoute(); err != nil {
-			errTag = "node route"
-			goto errHandle
-		}
-		if err = server.postNodeRouteHandler(client); err != nil {
-			errTag = "after node route"
-			goto errHandle
-		}
-		if err = client.BackendProc(); err != nil {
-			errTag = "backend proc"
-			goto errHandle
-		}
-		if err = server.postBackendProcHandler(client); err != nil {
-			errTag = "after backend proc"
-			goto errHandle
-		}
-		if err = client.Response(); err != nil {
-			errTag = "response"
+		if err != nil {
 			goto errHandle
 		}
-		if err = server.postFrontResponseHandler(client); err != nil {
-			errTag = "after response"
-			goto errHandle
+		// 关闭服务时, 处理完当前请求后退出
+		if server.IsStop() {
+			return
 		}
+		client.setIdle()
 	}
 errHandle:
 	if err != nil {
-		if err != io.EOF {
+		if reply, ok := err.(*replyError); ok {
+			// 切面在连接建立时拒绝客户端
+			reply.msg.WriteMsg(client.bw)
+			client.Close()
+			return
+		}
+		if protocol.IsProtocolError(err) {
+			// 请求格式错误或超出限制, 返回错误后关闭连接
+			protocol.NewProtocolErrorMsg(err).WriteMsg(client.bw)
+		}
+		// 被服务端主动关闭的客户端, 读取出错是预期的
+		if err != io.EOF && err != errServerStopped && !client.IsClosed() {
 			log.Errorf("[client][%s] %s err: %s", client.addr, errTag, err)
 		}
 		client.Close()
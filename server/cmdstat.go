@@ -0,0 +1,48 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"ncache/filter"
+	"ncache/stat"
+)
+
+func init() {
+	RegisterPlugin("cmdstat", newCmdstat)
+}
+
+// 按命令统计调用次数及总耗时, 通过 NCACHE STATS 查看
+type cmdstat struct {
+	// 命令名到统计项名称的缓存, 避免每次请求拼接字符串
+	names sync.Map
+}
+
+type cmdstatNames struct {
+	calls string
+	usec  string
+}
+
+func newCmdstat(json.RawMessage) (interface{}, error) {
+	return &cmdstat{}, nil
+}
+
+func (this *cmdstat) PostFrontResponse(client *Client) error {
+	// 只统计有效的命令, 避免未知命令产生大量统计项
+	if !filter.IsValidCmd(client.curCmd) {
+		return nil
+	}
+	var names *cmdstatNames
+	if v, ok := this.names.Load(client.curCmd); ok {
+		names = v.(*cmdstatNames)
+	} else {
+		cmd := strings.ToLower(client.curCmd)
+		names = &cmdstatNames{calls: "cmdstat_" + cmd + "_calls", usec: "cmdstat_" + cmd + "_usec"}
+		this.names.Store(client.curCmd, names)
+	}
+	stat.Incr(names.calls, 1)
+	stat.Incr(names.usec, int64(time.Now().Sub(client.start)/time.Microsecond))
+	return nil
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"ncache/config"
+	"ncache/protocol"
+)
+
+const (
+	defaultUser = "default"
+)
+
+// 本地处理的命令, 不转发到后端
+func (this *Client) procLocalCmd() *protocol.Msg {
+	switch this.curCmd {
+	case "PING":
+		return protocol.MsgPONG
+	case "HELLO":
+		return this.procHello()
+	case "AUTH":
+		return this.procAuth()
+	case "NCACHE":
+		return this.procNcache()
+	}
+	return protocol.NewErrorMsgFmt("ERR unknown command '%s'", this.curCmd)
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func (this *Client) procHello() *protocol.Msg {
+	protoVer := this.protoVer
+	if this.argc > 1 {
+		ver, err := strconv.Atoi(this.args[1])
+		if err != nil {
+			return protocol.NewErrorMsg("ERR Protocol version is not an integer or out of range")
+		}
+		if ver != protoVerResp2 && ver != protoVerResp3 {
+			return protocol.NewErrorMsg("NOPROTO unsupported protocol version")
+		}
+		protoVer = ver
+	}
+	var name, user string
+	for i := 2; i < this.argc; i++ {
+		option := strings.ToUpper(this.args[i])
+		switch {
+		case option == "AUTH" && i+2 < this.argc:
+			if !this.Server.checkPass(this.args[i+1], this.args[i+2]) {
+				return protocol.NewErrorMsg(errWrongPass)
+			}
+			user = this.args[i+1]
+			i += 2
+		case option == "SETNAME" && i+1 < this.argc:
+			name = this.args[i+1]
+			if strings.ContainsAny(name, " \n") {
+				return protocol.NewErrorMsg("ERR Client names cannot contain spaces, newlines or special characters.")
+			}
+			i++
+		default:
+			return protocol.NewErrorMsgFmt("ERR Syntax error in HELLO option '%s'", this.args[i])
+		}
+	}
+	if user != "" {
+		this.setUser(user)
+	}
+	// HELLO 自身的响应使用协商后的版本
+	this.protoVer, this.respVer = protoVer, protoVer
+	if name != "" {
+		this.name = name
+	}
+	return protocol.NewMapMsg([]*protocol.Msg{
+		protocol.NewBulkStringMsg([]byte("server")), protocol.NewBulkStringMsg([]byte("ncache")),
+		protocol.NewBulkStringMsg([]byte("version")), protocol.NewBulkStringMsg([]byte(config.GetVersion())),
+		protocol.NewBulkStringMsg([]byte("proto")), protocol.NewIntegerMsg(int64(this.protoVer)),
+		protocol.NewBulkStringMsg([]byte("id")), protocol.NewIntegerMsg(int64(this.id)),
+		protocol.NewBulkStringMsg([]byte("mode")), protocol.NewBulkStringMsg([]byte("proxy")),
+		protocol.NewBulkStringMsg([]byte("role")), protocol.NewBulkStringMsg([]byte("master")),
+		protocol.NewBulkStringMsg([]byte("modules")), protocol.NewArrayMsg([]*protocol.Msg{}),
+	})
+}
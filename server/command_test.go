@@ -0,0 +1,54 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"ncache/protocol"
+	"ncache/utils"
+)
+
+// pipeline 中 HELLO 之前的请求仍按原协议版本返回响应
+func TestHelloInPipeline(t *testing.T) {
+	var out bytes.Buffer
+	client := &Client{
+		Server:   &Server{},
+		protoVer: protoVerResp2,
+		br:       bufio.NewReader(strings.NewReader("*1\r\n$4\r\nPING\r\n*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n")),
+		bw:       bufio.NewWriter(&out),
+	}
+	var pipeline []reqState
+	for i := 0; i < 2; i++ {
+		utils.AssertMustNoError(client.CmdReceive())
+		utils.AssertMustNoError(client.CmdParse())
+		pipeline = append(pipeline, client.reqState)
+	}
+	utils.AssertMust(pipeline[0].respVer == protoVerResp2 && pipeline[1].respVer == protoVerResp3)
+
+	client.reqState = pipeline[0]
+	client.response = protocol.NewNullMsg()
+	utils.AssertMustNoError(client.Response())
+	client.bw.Flush()
+	utils.AssertMust(out.String() == "$-1\r\n")
+}
+
+// 未开启 admin_enable 时拒绝管理命令
+func TestAdminDisabled(t *testing.T) {
+	client := &Client{Server: &Server{}, protoVer: protoVerResp2}
+	str, _ := parseTestCmd(client, "NCACHE STATS").GetError()
+	utils.AssertMust(strings.HasPrefix(str, "ERR admin commands are disabled"))
+
+	client.Server.adminEnable = true
+	utils.AssertMust(!parseTestCmd(client, "NCACHE STATS").IsError())
+	str, _ = parseTestCmd(client, "NCACHE RELOAD ../../etc/db.json").GetError()
+	utils.AssertMust(strings.HasPrefix(str, "ERR reload file must be"))
+}
+
+// ROUTER 不由代理处理, 不受 admin_enable 控制, 按 key 转发到后端
+func TestRouterForwarded(t *testing.T) {
+	client := &Client{Server: &Server{}, protoVer: protoVerResp2}
+	utils.AssertMust(parseTestCmd(client, "ROUTER feed:1") == nil)
+	utils.AssertMust(client.stage == processRoute)
+}
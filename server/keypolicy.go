@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"ncache/config"
+	"ncache/filter"
+	"ncache/protocol"
+)
+
+// 同一前缀只能配置一条规则
+func (this *Server) initKeyPolicy(confs []config.KeyRuleConf) error {
+	this.keyPolicy = filter.NewKeyPolicy()
+	prefixes := make(map[string]bool, len(confs))
+	for _, conf := range confs {
+		prefix := strings.ToLower(conf.Prefix)
+		if prefix == "" {
+			return fmt.Errorf("Server: key rule prefix is empty")
+		}
+		if prefixes[prefix] {
+			return fmt.Errorf("Server: key rule for prefix %s defined twice", prefix)
+		}
+		prefixes[prefix] = true
+		rule, err := filter.NewKeyRule(conf.MaxLen, conf.Format, conf.ForbiddenGlob, conf.ForbiddenRegex)
+		if err != nil {
+			return err
+		}
+		this.keyPolicy.AddRule(prefix, rule)
+		this.keyPolicy.Block(conf.Blocklist...)
+	}
+	return nil
+}
+
+// 在路由之前检查请求中的所有 key, 使用请求转发的 backend (index) 对应的规则
+func (this *Client) checkKeys(index string) *protocol.Msg {
+	if this.Server.keyPolicy == nil {
+		return nil
+	}
+	keys := filter.GetKeys(this.curCmd, this.args)
+	if err := this.Server.keyPolicy.Check(keys, backendPrefix(index)); err != nil {
+		return protocol.NewErrorMsg("ERR " + err.Error())
+	}
+	return nil
+}
+
+// NCACHE BLOCKKEY ADD|DEL key [key ...] / NCACHE BLOCKKEY LIST
+func (this *Client) procBlockKey() *protocol.Msg {
+	if this.argc < 3 {
+		return protocol.NewErrorMsgFmt("ERR wrong number of arguments for '%s %s' command", this.curCmd, this.args[1])
+	}
+	keyPolicy := this.Server.keyPolicy
+	if keyPolicy == nil {
+		return protocol.NewErrorMsg("ERR key policy is not initialized")
+	}
+	op := strings.ToUpper(this.args[2])
+	switch op {
+	case "ADD", "DEL":
+		if this.argc < 4 {
+			return protocol.NewErrorMsgFmt("ERR wrong number of arguments for '%s %s %s' command", this.curCmd, this.args[1], op)
+		}
+		if op == "ADD" {
+			return protocol.NewIntegerMsg(int64(keyPolicy.Block(this.args[3:]...)))
+		}
+		return protocol.NewIntegerMsg(int64(keyPolicy.Unblock(this.args[3:]...)))
+	case "LIST":
+		// 黑名单为空时返回空数组而非 nil
+		keys := keyPolicy.BlockedKeys()
+		msgs := make([]*protocol.Msg, 0, len(keys))
+		for _, key := range keys {
+			msgs = append(msgs, protocol.NewBulkStringMsg([]byte(key)))
+		}
+		return protocol.NewArrayMsg(msgs)
+	}
+	return protocol.NewErrorMsgFmt("ERR unknown subcommand '%s'", this.args[2])
+}
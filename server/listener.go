@@ -0,0 +1,155 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"ncache/config"
+	"ncache/filter"
+)
+
+const (
+	networkTcp  = "tcp"
+	networkUnix = "unix"
+	// 检查已有的 socket 文件是否仍在使用
+	unixDialTimeout = time.Second
+)
+
+// 监听端口或 unix socket, 可以绑定默认的 backend 及限制可执行的命令
+type listener struct {
+	net.Listener
+	addr string
+	// 不为空时所有请求转发到该 backend, 不再按 key 前缀路由
+	backend string
+	// 不为空时只能执行其中的命令
+	commands  map[string]bool
+	tlsConfig *tls.Config
+	// *filter.IpFilter, 重新加载配置时替换
+	ipFilter atomic.Value
+	// 连接建立时先读取 PROXY 协议头, 使用其中的客户端地址
+	proxyProtocol bool
+	// 允许发送 PROXY 协议头的地址
+	proxyTrusted *filter.IpFilter
+}
+
+func newListener(conf config.ListenerConf) (*listener, error) {
+	network := listenerNetwork(conf)
+	var (
+		l   net.Listener
+		err error
+	)
+	switch network {
+	case networkTcp:
+		l, err = net.Listen(networkTcp, conf.Address)
+	case networkUnix:
+		l, err = listenUnix(conf.Address, conf.Mode)
+	default:
+		return nil, fmt.Errorf("Server: unknown listener network %s", conf.Network)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ln := &listener{
+		Listener:      l,
+		addr:          listenerAddr(conf),
+		backend:       conf.Backend,
+		proxyProtocol: conf.ProxyProtocol,
+	}
+	ipFilter, err := newIpFilter(conf.IpFilter)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	ln.setIpFilter(ipFilter)
+	if conf.ProxyProtocol {
+		if len(conf.ProxyTrusted) == 0 {
+			l.Close()
+			return nil, fmt.Errorf("Server: listener %s enables proxy_protocol without proxy_trusted", ln.addr)
+		}
+		if ln.proxyTrusted, err = filter.NewIpFilter(conf.ProxyTrusted, nil); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	// PROXY 协议头在 TLS 握手之前, 因此不使用 tls.NewListener, 由 Server 在读取协议头后建立 TLS
+	if conf.Tls != nil {
+		if ln.tlsConfig, err = conf.Tls.ServerConfig(); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	if len(conf.Commands) > 0 {
+		ln.commands = make(map[string]bool, len(conf.Commands))
+		for _, cmd := range conf.Commands {
+			ln.commands[strings.ToUpper(cmd)] = true
+		}
+	}
+	return ln, nil
+}
+
+func listenerNetwork(conf config.ListenerConf) string {
+	if conf.Network == "" {
+		return networkTcp
+	}
+	return strings.ToLower(conf.Network)
+}
+
+// 如 tcp://127.0.0.1:6379, 重新加载配置时用于查找对应的 listener
+func listenerAddr(conf config.ListenerConf) string {
+	return listenerNetwork(conf) + "://" + conf.Address
+}
+
+// 未配置时返回 nil, 不限制
+func newIpFilter(conf *config.IpFilterConf) (*filter.IpFilter, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	return filter.NewIpFilter(conf.Allow, conf.Deny)
+}
+
+func (this *listener) setIpFilter(ipFilter *filter.IpFilter) {
+	this.ipFilter.Store(ipFilter)
+}
+
+func (this *listener) getIpFilter() *filter.IpFilter {
+	ipFilter, _ := this.ipFilter.Load().(*filter.IpFilter)
+	return ipFilter
+}
+
+// 删除上次未正常退出时残留的 socket 文件, 监听后按 mode 设置文件权限.
+// socket 文件仍可连接时说明有其他进程在监听, 不删除
+func listenUnix(path, mode string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.DialTimeout(networkUnix, path, unixDialTimeout); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("Server: unix socket %s is in use", path)
+		}
+		os.Remove(path)
+	}
+	l, err := net.Listen(networkUnix, path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != "" {
+		perm, err := strconv.ParseUint(mode, 8, 32)
+		if err == nil {
+			err = os.Chmod(path, os.FileMode(perm))
+		}
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("Server: chmod %s: %s", path, err)
+		}
+	}
+	return l, nil
+}
+
+// 连接认证相关的命令不受限制
+func (this *listener) isCmdAllowed(cmd string) bool {
+	return this == nil || this.commands == nil || this.commands[cmd] || isNoAuthCmd(cmd)
+}
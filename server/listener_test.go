@@ -0,0 +1,108 @@
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ncache/config"
+	"ncache/utils"
+)
+
+func TestNewListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ncache.sock")
+	l, err := newListener(config.ListenerConf{
+		Network:  "unix",
+		Address:  path,
+		Mode:     "0600",
+		Backend:  "feed",
+		Commands: []string{"get", "set"},
+	})
+	utils.AssertMustNoError(err)
+	defer l.Close()
+	info, err := os.Stat(path)
+	utils.AssertMustNoError(err)
+	utils.AssertMust(info.Mode().Perm() == 0600)
+	utils.AssertMust(l.backend == "feed")
+	utils.AssertMust(l.isCmdAllowed("GET") && l.isCmdAllowed("AUTH") && !l.isCmdAllowed("DEL"))
+
+	conn, err := net.Dial("unix", path)
+	utils.AssertMustNoError(err)
+	conn.Close()
+
+	// 其他进程仍在监听时不删除 socket 文件
+	_, err = newListener(config.ListenerConf{Network: "unix", Address: path})
+	utils.AssertMust(err != nil)
+	_, err = os.Stat(path)
+	utils.AssertMustNoError(err)
+
+	var nilListener *listener
+	utils.AssertMust(nilListener.isCmdAllowed("DEL"))
+	_, err = newListener(config.ListenerConf{Network: "udp", Address: "127.0.0.1:0"})
+	utils.AssertMust(err != nil)
+}
+
+// 残留的 socket 文件在监听前删除
+func TestListenUnixStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ncache.sock")
+	l, err := net.Listen("unix", path)
+	utils.AssertMustNoError(err)
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = listenUnix(path, "")
+	utils.AssertMustNoError(err)
+	l.Close()
+}
+
+// 单 ip 连接数限制不作用于 unix socket 连接
+func TestAddClientPerIp(t *testing.T) {
+	server := &Server{clients: make(map[uint64]*Client), ipClients: make(map[string]int), maxClientPerIp: 1}
+	utils.AssertMustNoError(server.addClient(&Client{id: 1, ip: "@"}))
+	utils.AssertMustNoError(server.addClient(&Client{id: 2, ip: "@"}))
+	utils.AssertMustNoError(server.addClient(&Client{id: 3, ip: "10.0.0.1"}))
+	utils.AssertMust(server.addClient(&Client{id: 4, ip: "10.0.0.1"}) == errMaxClientsPerIp)
+}
+
+// 超出连接数的 TLS 连接在单独的协程中拒绝, 客户端不发送数据时不阻塞 Accept, 超时后关闭
+func TestRejectTlsConn(t *testing.T) {
+	server := &Server{clients: map[uint64]*Client{1: {id: 1}}, ipClients: make(map[string]int), maxClient: 1}
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	done := make(chan struct{})
+	go func() {
+		server.handleConn(&listener{tlsConfig: &tls.Config{}}, conn)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		utils.AssertMust(false)
+	}
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := peer.Read(make([]byte, 1))
+	utils.AssertMust(err == io.EOF)
+}
+
+func TestIsIpAllowed(t *testing.T) {
+	l, err := newListener(config.ListenerConf{
+		Address:  "127.0.0.1:0",
+		IpFilter: &config.IpFilterConf{Allow: []string{"10.0.0.0/8"}},
+	})
+	utils.AssertMustNoError(err)
+	defer l.Close()
+	server := &Server{}
+	utils.AssertMust(server.isIpAllowed(l, "10.1.0.1") && !server.isIpAllowed(l, "127.0.0.1"))
+	ipFilter, err := newIpFilter(&config.IpFilterConf{Deny: []string{"10.1.0.0/16"}})
+	utils.AssertMustNoError(err)
+	server.ipFilter.Store(ipFilter)
+	utils.AssertMust(server.isIpAllowed(l, "10.2.0.1") && !server.isIpAllowed(l, "10.1.0.1"))
+	_, err = newListener(config.ListenerConf{
+		Address:  "127.0.0.1:0",
+		IpFilter: &config.IpFilterConf{Deny: []string{"bad"}},
+	})
+	utils.AssertMust(err != nil)
+}
@@ -1,5 +1,12 @@
 package server
 
+import (
+	"encoding/json"
+	"errors"
+
+	"ncache/protocol"
+)
+
 //定义切面行为
 
 //前端连接建立后执行
@@ -40,3 +47,70 @@ type NcacheAspect interface {
 	PostBackendProc
 	PostFrontResponse
 }
+
+// 插件工厂, conf 为配置文件中该插件的配置, 未配置时为空
+type PluginFactory func(conf json.RawMessage) (interface{}, error)
+
+var (
+	pluginFactories = make(map[string]PluginFactory)
+
+	errInvalidAspect = errors.New("Server: aspect implements no hook")
+)
+
+// 注册插件, 需在 NewServer 之前调用, 一般在 init 中注册
+func RegisterPlugin(name string, factory PluginFactory) {
+	if _, ok := pluginFactories[name]; ok {
+		panic("Server: plugin registered twice: " + name)
+	}
+	pluginFactories[name] = factory
+}
+
+// 切面返回 Reply 时, 跳过后续处理阶段, 直接向客户端返回 msg, 连接保持.
+// PostFrontConnect 中返回时写入 msg 后关闭连接, PostFrontResponse 中返回时被忽略
+func Reply(msg *protocol.Msg) error {
+	return &replyError{msg: msg}
+}
+
+type replyError struct {
+	msg *protocol.Msg
+}
+
+func (this *replyError) Error() string {
+	return "Server: aspect reply"
+}
+
+// 按处理阶段分类的切面, 同一切面可实现其中任意几个
+type aspectSet struct {
+	connect  []PostFrontConnect
+	receive  []PostCommandReceive
+	parse    []PostCommandParse
+	route    []PostNodeRoute
+	backend  []PostBackendProc
+	response []PostFrontResponse
+}
+
+func (this *aspectSet) add(aspect interface{}) error {
+	added := false
+	if a, ok := aspect.(PostFrontConnect); ok {
+		this.connect, added = append(this.connect, a), true
+	}
+	if a, ok := aspect.(PostCommandReceive); ok {
+		this.receive, added = append(this.receive, a), true
+	}
+	if a, ok := aspect.(PostCommandParse); ok {
+		this.parse, added = append(this.parse, a), true
+	}
+	if a, ok := aspect.(PostNodeRoute); ok {
+		this.route, added = append(this.route, a), true
+	}
+	if a, ok := aspect.(PostBackendProc); ok {
+		this.backend, added = append(this.backend, a), true
+	}
+	if a, ok := aspect.(PostFrontResponse); ok {
+		this.response, added = append(this.response, a), true
+	}
+	if !added {
+		return errInvalidAspect
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"ncache/config"
+	"ncache/protocol"
+	"ncache/utils"
+)
+
+type testAspect struct{}
+
+func (this *testAspect) PostCommandParse(client *Client) error {
+	return Reply(protocol.MsgOK)
+}
+
+func (this *testAspect) PostFrontResponse(client *Client) error {
+	return Reply(protocol.MsgOK)
+}
+
+func TestAddAspect(t *testing.T) {
+	server := &Server{}
+	utils.AssertMustNoError(server.AddAspect(&testAspect{}))
+	utils.AssertMust(len(server.aspects.parse) == 1 && len(server.aspects.receive) == 0)
+	utils.AssertMust(len(server.aspects.response) == 1)
+	utils.AssertMust(server.AddAspect(struct{}{}) == errInvalidAspect)
+
+	client := &Client{Server: server}
+	client.stage = processParse
+	utils.AssertMustNoError(server.postCommandParseHandler(client))
+	utils.AssertMust(client.stage == processResponse && protocol.IsOkMsg(client.response))
+	utils.AssertMustNoError(server.postFrontResponseHandler(client))
+}
+
+func TestInitPlugins(t *testing.T) {
+	server := &Server{}
+	err := server.initPlugins([]config.PluginConf{
+		{Name: "cmdstat"},
+		{Name: "slowlog", Conf: json.RawMessage(`{"slower_than": 100}`)},
+	})
+	utils.AssertMustNoError(err)
+	utils.AssertMust(len(server.aspects.response) == 2)
+	utils.AssertMust(server.aspects.response[1].(*slowlog).slowerThan.Milliseconds() == 100)
+
+	utils.AssertMust(server.initPlugins([]config.PluginConf{{Name: "not_exists"}}) != nil)
+	utils.AssertMust(server.initPlugins([]config.PluginConf{{Name: "slowlog", Conf: json.RawMessage(`[]`)}}) != nil)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	proxyHeaderTimeout = 5 * time.Second
+	proxyV1MaxLen      = 107 // "PROXY TCP6 ..." 的最大长度, 包括 \r\n
+	proxyV2HeaderLen   = 16
+)
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errProxyHeader = errors.New("invalid proxy protocol header")
+)
+
+// 读取过 PROXY 协议头的连接, RemoteAddr 返回协议头中的客户端地址
+type proxyConn struct {
+	net.Conn
+	br         *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (this *proxyConn) Read(b []byte) (int, error) {
+	return this.br.Read(b)
+}
+
+func (this *proxyConn) RemoteAddr() net.Addr {
+	if this.remoteAddr != nil {
+		return this.remoteAddr
+	}
+	return this.Conn.RemoteAddr()
+}
+
+// 读取 PROXY 协议 v1/v2 头, 没有协议头时返回错误
+func readProxyHeader(conn net.Conn) (*proxyConn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	pc := &proxyConn{Conn: conn, br: bufio.NewReader(conn)}
+	var err error
+	if prefix, _ := pc.br.Peek(len(proxyV2Signature)); bytes.Equal(prefix, proxyV2Signature) {
+		pc.remoteAddr, err = readProxyV2(pc.br)
+	} else if prefix, _ = pc.br.Peek(len(proxyV1Prefix)); bytes.Equal(prefix, proxyV1Prefix) {
+		pc.remoteAddr, err = readProxyV1(pc.br)
+	} else {
+		err = errProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLen)
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLen {
+			return nil, errProxyHeader
+		}
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// 12 字节签名 + 版本/命令 + 地址族/协议 + 2 字节地址长度 + 地址
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyV2HeaderLen)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	addrs := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(br, addrs); err != nil {
+		return nil, err
+	}
+	switch header[12] & 0x0f {
+	case 0x0: // LOCAL, 负载均衡自身的健康检查, 使用原地址
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, errProxyHeader
+	}
+	switch header[13] {
+	case 0x11, 0x12: // TCP/UDP over IPv4
+		if len(addrs) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:4]), Port: int(binary.BigEndian.Uint16(addrs[8:10]))}, nil
+	case 0x21, 0x22: // TCP/UDP over IPv6
+		if len(addrs) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:16]), Port: int(binary.BigEndian.Uint16(addrs[32:34]))}, nil
+	default: // UNSPEC 及 unix socket 等, 使用原地址
+		return nil, nil
+	}
+}
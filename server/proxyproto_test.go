@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"ncache/config"
+	"ncache/utils"
+)
+
+func readProxyPipe(header []byte) (*proxyConn, error) {
+	client, server := net.Pipe()
+	go func() {
+		client.Write(header)
+		client.Write([]byte("PING\r\n"))
+		client.Close()
+	}()
+	return readProxyHeader(server)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	pc, err := readProxyPipe([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 6379\r\n"))
+	utils.AssertMustNoError(err)
+	utils.AssertMust(utils.RemoteAddr(pc) == "192.168.0.1:56324")
+	data, _ := io.ReadAll(pc)
+	utils.AssertMust(string(data) == "PING\r\n")
+
+	pc, err = readProxyPipe([]byte("PROXY UNKNOWN\r\n"))
+	utils.AssertMustNoError(err)
+	utils.AssertMust(utils.RemoteAddr(pc) == "pipe")
+
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x21, 0x11, 0, 12, 10, 0, 0, 1, 10, 0, 0, 2)
+	header = binary.BigEndian.AppendUint16(header, 40000)
+	header = binary.BigEndian.AppendUint16(header, 6379)
+	pc, err = readProxyPipe(header)
+	utils.AssertMustNoError(err)
+	utils.AssertMust(utils.RemoteAddr(pc) == "10.0.0.1:40000")
+	data, _ = io.ReadAll(pc)
+	utils.AssertMust(string(data) == "PING\r\n")
+
+	_, err = readProxyPipe([]byte("*1\r\n$4\r\nPING\r\n"))
+	utils.AssertMust(err == errProxyHeader)
+	_, err = readProxyPipe([]byte("PROXY TCP4 bad 192.168.0.11 56324 6379\r\n"))
+	utils.AssertMust(err == errProxyHeader)
+}
+
+// 经 listener 建立连接并发送 PROXY 协议头, 返回连接是否被关闭
+func proxyConnRejected(server *Server, l *listener, header string) bool {
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			server.handleProxyConn(l, conn)
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	utils.AssertMustNoError(err)
+	defer conn.Close()
+	conn.Write([]byte(header))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	return err == io.EOF
+}
+
+// 只接受可信地址的 PROXY 协议头, 实际地址及协议头中的地址均需通过黑白名单
+func TestProxyTrusted(t *testing.T) {
+	_, err := newListener(config.ListenerConf{Address: "127.0.0.1:0", ProxyProtocol: true})
+	utils.AssertMust(err != nil)
+
+	server := &Server{clients: make(map[uint64]*Client), ipClients: make(map[string]int)}
+	header := "PROXY TCP4 10.0.0.1 10.0.0.2 56324 6379\r\n"
+	confs := []config.ListenerConf{
+		{ProxyTrusted: []string{"10.0.0.0/8"}},
+		{ProxyTrusted: []string{"127.0.0.1"}, IpFilter: &config.IpFilterConf{Deny: []string{"127.0.0.1"}}},
+		{ProxyTrusted: []string{"127.0.0.0/8"}, IpFilter: &config.IpFilterConf{Deny: []string{"10.0.0.1"}}},
+	}
+	for _, conf := range confs {
+		conf.Address, conf.ProxyProtocol = "127.0.0.1:0", true
+		l, err := newListener(conf)
+		utils.AssertMustNoError(err)
+		utils.AssertMust(proxyConnRejected(server, l, header))
+		l.Close()
+	}
+	utils.AssertMust(server.clientNum() == 0)
+}
@@ -1,57 +1,180 @@
 package server
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/janic716/golib/log"
+	"ncache/backend/nodes"
+	"ncache/backend/route"
 	"ncache/config"
+	"ncache/filter"
+	"ncache/protocol"
+	"ncache/rule"
+	"ncache/stat"
+	"ncache/utils"
+)
+
+const (
+	shutdownCheckInterval = 50 * time.Millisecond
+	rejectTimeout         = 100 * time.Millisecond
+
+	statConnReceived      = "total_connections_received"
+	statConnRejected      = "rejected_connections"
+	statConnRejectedPerIp = "rejected_connections_per_ip"
+	statConnClients       = "connected_clients"
+	statRequestTimeout    = "request_timeouts"
+	statClientTimeout     = "timeout_clients_closed"
+	statClientIdle        = "idle_clients_closed"
+	statConnRejectedIp    = "rejected_connections_ip"
+
+	ipRejectLogInterval = 1 // 拒绝连接的日志每秒最多打印一次
+)
+
+var (
+	errMaxClients      = errors.New("max number of clients reached")
+	errMaxClientsPerIp = errors.New("max number of clients per ip reached")
+	errIpNotAllowed    = errors.New("client ip not allowed")
 )
 
 type Server struct {
 	conf              *config.ServerConf
 	addr              string
-	listener          net.Listener
+	listeners         []*listener
 	mutex             sync.RWMutex
 	clients           map[uint64]*Client
-	aspectList        []NcacheAspect
-	stop              bool
+	ipClients         map[string]int
+	aspects           aspectSet
+	stop              int32
 	timerTaskInterval int
 	maxClientIdleTime int64
+	// 单个请求的最长处理时间, 0 为不限制
+	requestTimeout time.Duration
+	// 客户端停留在同一处理阶段的最长时间, 单位秒
+	clientStageTimeout int64
+	maxClient          int
+	maxClientPerIp     int
+	adminEnable        bool
+	reloadMutex        sync.Mutex
+	// 用户名到密码 sha256 值, 为空时不需要认证
+	users map[string][]byte
+	// 用户的访问权限, 未配置的用户不限制
+	acls map[string]*filter.Acl
+	// 客户端证书 CN 到用户名
+	certUsers map[string]string
+	// *filter.IpFilter, 对所有 listener 生效, 重新加载配置时替换
+	ipFilter atomic.Value
+	// key 规则及黑名单
+	keyPolicy *filter.KeyPolicy
+	// 上次打印拒绝连接日志的时间及之后被拒绝的连接数
+	ipRejectLogTime int64
+	ipRejectCount   int64
 }
 
 //todo:
 func NewServer() (server *Server, err error) {
 	server = &Server{
-		clients: make(map[uint64]*Client),
+		clients:   make(map[uint64]*Client),
+		ipClients: make(map[string]int),
 	}
 	conf, err := config.GetServerConf()
 	if err != nil {
 		log.Error("server configurateion initialize failed")
 	}
-	addr := conf.Address
-	port := conf.ServerPort
-	address := strings.Join([]string{addr, strconv.FormatInt(int64(port), 10)}, ":")
-	if server.listener, err = net.Listen("tcp", address); err != nil {
-		log.Infof("new server listen failed, addr: %s, err: %s", address, err)
+	if err = server.initPlugins(conf.Plugins); err != nil {
+		return nil, err
+	}
+	if err = server.initUsers(conf.Users); err != nil {
 		return nil, err
 	}
+	if err = server.initKeyPolicy(conf.KeyRules); err != nil {
+		return nil, err
+	}
+	routeTable, err := rule.NewRouteTable(conf.RouteRules)
+	if err != nil {
+		return nil, err
+	}
+	rule.SetRouteTable(routeTable)
+	ipFilter, err := newIpFilter(conf.IpFilter)
+	if err != nil {
+		return nil, err
+	}
+	server.ipFilter.Store(ipFilter)
+	address := serverAddress(conf)
+	for _, listenerConf := range listenerConfs(conf) {
+		var l *listener
+		if l, err = newListener(listenerConf); err != nil {
+			log.Infof("new server listen failed, addr: %s, err: %s", listenerConf.Address, err)
+			server.closeListeners()
+			return nil, err
+		}
+		server.listeners = append(server.listeners, l)
+	}
 	server.conf = conf
 	server.addr = address
 	server.timerTaskInterval = conf.TimeTaskInterval
 	server.maxClientIdleTime = int64(conf.MaxClientIdle)
-	log.Infof("[server]new server starting, addr: %s", address)
+	server.maxClient = conf.MaxClient
+	server.maxClientPerIp = conf.MaxClientPerIp
+	server.adminEnable = conf.AdminEnable
+	server.requestTimeout = time.Duration(conf.RequestTimeout) * time.Millisecond
+	// 超时的请求不会一直占用后端连接
+	nodes.SetMaxIoTimeout(server.requestTimeout)
+	server.clientStageTimeout = int64(conf.ClientStageTimeout)
+	stat.RegisterInfo(func() map[string]int64 {
+		return map[string]int64{statConnClients: int64(server.clientNum())}
+	})
+	protocol.SetLimits(protocol.Limits{
+		MaxBulkLen:      conf.MaxBulkLen,
+		MaxMultiBulkLen: conf.MaxMultiBulkLen,
+		MaxRequestSize:  conf.MaxRequestSize,
+		MaxNesting:      conf.MaxNesting,
+	})
+	for _, l := range server.listeners {
+		log.Infof("[server]new server starting, addr: %s", l.addr)
+	}
 	return
 }
 
-//todo:
-func (this *Server) initAspect() {
-	if this.aspectList == nil {
-		this.aspectList = make([]NcacheAspect, 0, 2)
+func serverAddress(conf *config.ServerConf) string {
+	return strings.Join([]string{conf.Address, strconv.FormatInt(int64(conf.ServerPort), 10)}, ":")
+}
+
+// address:server_port 及 listeners 中的监听地址
+func listenerConfs(conf *config.ServerConf) []config.ListenerConf {
+	mainConf := config.ListenerConf{
+		Address:       serverAddress(conf),
+		Tls:           conf.Tls,
+		ProxyProtocol: conf.ProxyProtocol,
+		ProxyTrusted:  conf.ProxyTrusted,
 	}
+	return append([]config.ListenerConf{mainConf}, conf.Listeners...)
+}
+
+// 按配置顺序创建并注册插件
+func (this *Server) initPlugins(confs []config.PluginConf) error {
+	for _, conf := range confs {
+		factory, ok := pluginFactories[conf.Name]
+		if !ok {
+			return fmt.Errorf("Server: unknown plugin %s", conf.Name)
+		}
+		aspect, err := factory(conf.Conf)
+		if err != nil {
+			return fmt.Errorf("Server: init plugin %s: %s", conf.Name, err)
+		}
+		if err = this.AddAspect(aspect); err != nil {
+			return fmt.Errorf("Server: add plugin %s: %s", conf.Name, err)
+		}
+		log.Infof("[server] plugin %s enabled", conf.Name)
+	}
+	return nil
 }
 
 //todo:
@@ -59,45 +182,118 @@ func (this *Server) initStatus() {
 
 }
 
-func (this *Server) AddAspect(aspect NcacheAspect) {
-	if this.stop {
-		this.aspectList = append(this.aspectList, aspect)
-	}
+// 添加切面, aspect 需实现 PostFrontConnect 等接口中的至少一个.
+// 需在 Run 之前调用, 执行顺序与添加顺序一致
+func (this *Server) AddAspect(aspect interface{}) error {
+	return this.aspects.add(aspect)
 }
 
 func (this *Server) Run() {
 	this.initStatus()
-	this.stop = false
+	atomic.StoreInt32(&this.stop, 0)
 	go this.timerTask()
-	for !this.stop {
-		if conn, err := this.listener.Accept(); err != nil {
+	wg := &sync.WaitGroup{}
+	for _, l := range this.listeners {
+		wg.Add(1)
+		go func(l *listener) {
+			defer wg.Done()
+			this.serve(l)
+		}(l)
+	}
+	wg.Wait()
+}
+
+// 所有监听共用同一套客户端处理流程
+func (this *Server) serve(l *listener) {
+	for !this.IsStop() {
+		if conn, err := l.Accept(); err != nil {
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				time.Sleep(10 * time.Millisecond)
 				continue
 			}
-			log.Errorf("[server] accept err: %s", err)
+			if this.IsStop() {
+				break
+			}
+			log.Errorf("[server] %s accept err: %s", l.addr, err)
 		} else {
-			if client, err := NewClient(this, conn); err == nil {
-				this.addClient(client)
-				go clientHandler(client)
+			stat.Incr(statConnReceived, 1)
+			if l.proxyProtocol {
+				// 读取 PROXY 协议头可能阻塞, 在单独的协程中处理
+				go this.handleProxyConn(l, conn)
 			} else {
-				log.Errorf("[server] create client err: %s", err)
+				this.handleConn(l, conn)
 			}
 		}
 	}
-	this.listener = nil
 }
 
-func (this *Server) addClient(client *Client) {
+// 只接受可信地址发送的 PROXY 协议头, 连接的实际地址与协议头中的客户端地址均需通过 ip 黑白名单
+func (this *Server) handleProxyConn(l *listener, conn net.Conn) {
+	ip := utils.RemoteIp(conn)
+	if !l.proxyTrusted.Allow(ip) {
+		log.Warningf("[server] %s reject proxy conn from untrusted %s", l.addr, utils.RemoteAddr(conn))
+		conn.Close()
+		return
+	}
+	if !this.isIpAllowed(l, ip) {
+		this.rejectIp(l, ip)
+		conn.Close()
+		return
+	}
+	proxyConn, err := readProxyHeader(conn)
+	if err != nil {
+		log.Warningf("[server] %s read proxy header from %s err: %s", l.addr, utils.RemoteAddr(conn), err)
+		conn.Close()
+		return
+	}
+	this.handleConn(l, proxyConn)
+}
+
+func (this *Server) handleConn(l *listener, conn net.Conn) {
+	if ip := utils.RemoteIp(conn); !this.isIpAllowed(l, ip) {
+		this.rejectIp(l, ip)
+		conn.Close()
+		return
+	}
+	if l.tlsConfig != nil {
+		conn = tls.Server(conn, l.tlsConfig)
+	}
+	if client, err := NewClient(this, conn); err == nil {
+		client.listener = l
+		if err = this.addClient(client); err != nil {
+			// TLS 连接写入前需先完成握手, 握手要读取客户端数据, 在单独的协程中拒绝以免阻塞 Accept
+			go rejectConn(conn, err)
+			return
+		}
+		go clientHandler(client)
+	} else {
+		log.Errorf("[server] create client err: %s", err)
+	}
+}
+
+// 超出连接数限制时返回错误
+func (this *Server) addClient(client *Client) error {
+	ip := client.ip
 	this.mutex.Lock()
 	defer this.mutex.Unlock()
+	if this.maxClient > 0 && len(this.clients) >= this.maxClient {
+		stat.Incr(statConnRejected, 1)
+		return errMaxClients
+	}
+	// unix socket 等没有 ip 的连接不受单 ip 连接数限制
+	if this.maxClientPerIp > 0 && net.ParseIP(ip) != nil && this.ipClients[ip] >= this.maxClientPerIp {
+		stat.Incr(statConnRejectedPerIp, 1)
+		return errMaxClientsPerIp
+	}
 	this.clients[client.id] = client
+	this.ipClients[ip]++
+	return nil
 }
 
 func (this *Server) removeClient(client *Client) {
 	this.mutex.Lock()
 	defer this.mutex.Unlock()
-	delete(this.clients, client.id)
+	this.deleteClient(client.id)
 }
 
 func (this *Server) removeClientList(clientList []*Client) {
@@ -105,25 +301,69 @@ func (this *Server) removeClientList(clientList []*Client) {
 		this.mutex.Lock()
 		defer this.mutex.Unlock()
 		for _, client := range clientList {
-			delete(this.clients, client.id)
+			this.deleteClient(client.id)
 		}
 	}
 }
 
-//todo: 定时任务
+// 需持有写锁
+func (this *Server) deleteClient(id uint64) {
+	client, ok := this.clients[id]
+	if !ok {
+		return
+	}
+	delete(this.clients, id)
+	if this.ipClients[client.ip]--; this.ipClients[client.ip] <= 0 {
+		delete(this.ipClients, client.ip)
+	}
+}
+
+func (this *Server) clientNum() int {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return len(this.clients)
+}
+
+// 需同时通过全局及 listener 的黑白名单
+func (this *Server) isIpAllowed(l *listener, ip string) bool {
+	ipFilter, _ := this.ipFilter.Load().(*filter.IpFilter)
+	return ipFilter.Allow(ip) && l.getIpFilter().Allow(ip)
+}
+
+// 扫描等场景下拒绝的连接可能很多, 限制日志的打印频率
+func (this *Server) rejectIp(l *listener, ip string) {
+	stat.Incr(statConnRejectedIp, 1)
+	count := atomic.AddInt64(&this.ipRejectCount, 1)
+	now := utils.UnixTime()
+	last := atomic.LoadInt64(&this.ipRejectLogTime)
+	if now-last >= ipRejectLogInterval && atomic.CompareAndSwapInt64(&this.ipRejectLogTime, last, now) {
+		atomic.AddInt64(&this.ipRejectCount, -count)
+		log.Warningf("[server] %s reject conn from %s: %s, %d rejected since last log", l.addr, ip, errIpNotAllowed, count)
+	}
+}
+
+// 拒绝连接, 返回错误信息后关闭. 读写 (包括 TLS 握手) 均受超时限制
+func rejectConn(conn net.Conn, err error) {
+	log.Warningf("[server] reject conn %s: %s", utils.RemoteAddr(conn), err)
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+	protocol.NewErrorMsg("ERR " + err.Error()).WriteMsg(conn)
+	conn.Close()
+}
+
+// 定时任务, 服务停止后退出
 func (this *Server) timerTask() {
-	for !this.stop {
-		for {
-			if this.timerTaskInterval == 0 {
-				this.timerTaskInterval = 10
-			}
-			select {
-			case <-time.Tick(time.Duration(this.timerTaskInterval) * time.Second):
-				this.clearClosedClients()
-				this.clearIdleClients()
-				this.clearTimeoutClients()
-			}
+	if this.timerTaskInterval == 0 {
+		this.timerTaskInterval = 10
+	}
+	ticker := time.NewTicker(time.Duration(this.timerTaskInterval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if this.IsStop() {
+			return
 		}
+		this.clearClosedClients()
+		this.clearIdleClients()
+		this.clearTimeoutClients()
 	}
 }
 
@@ -133,41 +373,167 @@ func (this *Server) clearClosedClients() {
 	defer this.mutex.Unlock()
 	for k, c := range this.clients {
 		if c.IsClosed() {
-			delete(this.clients, k)
+			this.deleteClient(k)
 		}
 	}
 }
 
-//todo: 清理空闲的client
+// 关闭空闲超时的 client, 由 clientHandler 退出时移除
 func (this *Server) clearIdleClients() {
-	this.mutex.Lock()
-	defer this.mutex.Unlock()
-	for k, c := range this.clients {
-		if c.IsIdle(this.maxClientIdleTime) {
-			delete(this.clients, k)
+	if this.maxClientIdleTime <= 0 {
+		return
+	}
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	for _, c := range this.clients {
+		if c.IsIdle(this.maxClientIdleTime) && c.closeIfIdle() {
+			stat.Incr(statClientIdle, 1)
 		}
 	}
 }
 
-//todo: 清理超时的client
+// 关闭停留在同一处理阶段超时的 client, 如阻塞在后端处理或写响应上
 func (this *Server) clearTimeoutClients() {
+	if this.clientStageTimeout <= 0 {
+		return
+	}
+	now := utils.UnixTime()
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	for _, c := range this.clients {
+		if c.isStageTimeout(now, this.clientStageTimeout) {
+			log.Warningf("[server] close client %s, stage timeout", c.addr)
+			stat.Incr(statClientTimeout, 1)
+			c.Close()
+		}
+	}
+}
 
+// 重新加载 backend 配置, file 为空时重新加载当前的配置文件
+func (this *Server) Reload(file string) (err error) {
+	this.reloadMutex.Lock()
+	defer this.reloadMutex.Unlock()
+	applyServerConf, err := this.loadServerConf()
+	if err != nil {
+		return err
+	}
+	if err = this.reloadBackends(file); err != nil {
+		return err
+	}
+	// 路由规则可能指向新增的 backend, backend 重新加载成功后再替换
+	applyServerConf()
+	return nil
+}
+
+func (this *Server) reloadBackends(file string) (err error) {
+	if file == "" {
+		err = config.ReloadDbConf()
+	} else {
+		err = config.ReloadDbConfSpecifiedFile(file)
+	}
+	if config.IsNoNeedReload(err) {
+		log.Infof("[server] reload backend conf, conf not changed")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = route.Reload(config.GetReloadBackendConfs()); err != nil {
+		config.ResetReload()
+		return err
+	}
+	config.CommitReload()
+	return nil
 }
 
+// 重新读取 server 配置文件中的黑白名单及路由规则, 全部解析成功后返回替换函数
+func (this *Server) loadServerConf() (func(), error) {
+	conf, err := config.ReloadServerConf()
+	if err != nil {
+		return nil, err
+	}
+	ipFilter, err := newIpFilter(conf.IpFilter)
+	if err != nil {
+		return nil, err
+	}
+	listenerFilters := make(map[string]*filter.IpFilter)
+	for _, listenerConf := range listenerConfs(conf) {
+		if listenerFilters[listenerAddr(listenerConf)], err = newIpFilter(listenerConf.IpFilter); err != nil {
+			return nil, err
+		}
+	}
+	routeTable, err := rule.NewRouteTable(conf.RouteRules)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		this.ipFilter.Store(ipFilter)
+		for _, l := range this.listeners {
+			l.setIpFilter(listenerFilters[l.addr])
+		}
+		rule.SetRouteTable(routeTable)
+		log.Infof("[server] reload ip filter and route rules")
+	}, nil
+}
+
+// 停止接受新连接
 func (this *Server) Close() {
-	this.stop = true
+	atomic.StoreInt32(&this.stop, 1)
+	this.closeListeners()
+}
+
+func (this *Server) closeListeners() {
+	for _, l := range this.listeners {
+		l.Close()
+	}
+}
 
+// 优雅关闭: 停止接受新连接, 关闭空闲的客户端, 处理中的客户端在完成当前请求后退出.
+// 超过 timeout 仍未退出的客户端被强制关闭, 此时返回 false
+func (this *Server) Shutdown(timeout time.Duration) bool {
+	this.Close()
+	deadline := time.Now().Add(timeout)
+	for {
+		if this.closeIdleClients() == 0 {
+			log.Infof("[server] shutdown, all clients closed")
+			return true
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(shutdownCheckInterval)
+	}
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	log.Warningf("[server] shutdown timeout, force close %d clients", len(this.clients))
+	for _, c := range this.clients {
+		c.Close()
+	}
+	return false
+}
+
+// 关闭空闲的客户端, 返回剩余的客户端数
+func (this *Server) closeIdleClients() int {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	left := 0
+	for _, c := range this.clients {
+		if !c.closeIfIdle() {
+			left++
+		}
+	}
+	return left
 }
 
 func (this *Server) IsStop() bool {
-	return this.stop
+	return atomic.LoadInt32(&this.stop) == 1
 }
 
 func (this *Server) postFrontConnectHandler(client *Client) (err error) {
 	if client == nil || client.IsClosed() {
 		return errClientClosed
 	}
-	for _, aspect := range this.aspectList {
+	for _, aspect := range this.aspects.connect {
 		if err = aspect.PostFrontConnect(client); err != nil {
 			return
 		}
@@ -179,9 +545,9 @@ func (this *Server) postCommandReceiveHandler(client *Client) (err error) {
 	if client == nil || client.IsClosed() {
 		return errClientClosed
 	}
-	for _, aspect := range this.aspectList {
+	for _, aspect := range this.aspects.receive {
 		if err = aspect.PostCommandReceive(client); err != nil {
-			return
+			return client.aspectReply(err)
 		}
 	}
 	return
@@ -190,9 +556,9 @@ func (this *Server) postCommandParseHandler(client *Client) (err error) {
 	if client == nil || client.IsClosed() {
 		return errClientClosed
 	}
-	for _, aspect := range this.aspectList {
+	for _, aspect := range this.aspects.parse {
 		if err = aspect.PostCommandParse(client); err != nil {
-			return
+			return client.aspectReply(err)
 		}
 	}
 	return
@@ -202,9 +568,9 @@ func (this *Server) postNodeRouteHandler(client *Client) (err error) {
 	if client == nil || client.IsClosed() {
 		return errClientClosed
 	}
-	for _, aspect := range this.aspectList {
+	for _, aspect := range this.aspects.route {
 		if err = aspect.PostNodeRoute(client); err != nil {
-			return
+			return client.aspectReply(err)
 		}
 	}
 	return
@@ -214,16 +580,21 @@ func (this *Server) postBackendProcHandler(client *Client) (err error) {
 	if client == nil || client.IsClosed() {
 		return errClientClosed
 	}
-	for _, aspect := range this.aspectList {
+	for _, aspect := range this.aspects.backend {
 		if err = aspect.PostBackendProc(client); err != nil {
-			return
+			return client.aspectReply(err)
 		}
 	}
 	return
 }
 func (this *Server) postFrontResponseHandler(client *Client) (err error) {
-	for _, aspect := range this.aspectList {
+	for _, aspect := range this.aspects.response {
 		if err = aspect.PostFrontResponse(client); err != nil {
+			// 响应已写入, Reply 不再生效, 也不关闭连接
+			if _, ok := err.(*replyError); ok {
+				err = nil
+				continue
+			}
 			return
 		}
 	}
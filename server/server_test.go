@@ -0,0 +1,22 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+
+	"ncache/config"
+	"ncache/rule"
+	"ncache/utils"
+)
+
+// backend 重新加载失败时不替换路由规则
+func TestReloadKeepsRouteTable(t *testing.T) {
+	table, err := rule.NewRouteTable([]config.RouteRuleConf{{Type: rule.RoutePrefix, Pattern: "a", Backend: "b"}})
+	utils.AssertMustNoError(err)
+	rule.SetRouteTable(table)
+	defer rule.SetRouteTable(&rule.RouteTable{})
+
+	server := &Server{}
+	utils.AssertMust(server.Reload(filepath.Join(t.TempDir(), "db.json")) != nil)
+	utils.AssertMust(rule.GetRouteTable() == table)
+}
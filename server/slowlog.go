@@ -0,0 +1,50 @@
+package server
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/janic716/golib/log"
+	"ncache/stat"
+)
+
+const (
+	defaultSlowlogSlowerThan = 10 // 单位毫秒
+
+	statSlowlog = "slowlog_count"
+)
+
+func init() {
+	RegisterPlugin("slowlog", newSlowlog)
+}
+
+type slowlogConf struct {
+	// 处理时间超过该值的请求记录到日志, 单位毫秒
+	SlowerThan int64 `json:"slower_than"`
+}
+
+// 记录慢请求, 处理时间从读取请求开始到写入响应为止
+type slowlog struct {
+	slowerThan time.Duration
+}
+
+func newSlowlog(raw json.RawMessage) (interface{}, error) {
+	conf := slowlogConf{SlowerThan: defaultSlowlogSlowerThan}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &conf); err != nil {
+			return nil, err
+		}
+	}
+	return &slowlog{slowerThan: time.Duration(conf.SlowerThan) * time.Millisecond}, nil
+}
+
+func (this *slowlog) PostFrontResponse(client *Client) error {
+	if client.curReq == nil {
+		return nil
+	}
+	if cost := time.Now().Sub(client.start); cost >= this.slowerThan {
+		stat.Incr(statSlowlog, 1)
+		log.Warningf("[slowlog][%s] cost: %s request: %s", client.addr, cost, client.curReq)
+	}
+	return nil
+}
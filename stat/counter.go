@@ -0,0 +1,70 @@
+package stat
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// 提供实时统计值, 如当前连接数, 在 Snapshot 时调用
+type InfoFunc func() map[string]int64
+
+var (
+	counters      = make(map[string]*int64)
+	counterRWLock sync.RWMutex
+	infoFuncs     []InfoFunc
+	infoRWLock    sync.RWMutex
+)
+
+func getCounter(name string) *int64 {
+	counterRWLock.RLock()
+	counter, ok := counters[name]
+	counterRWLock.RUnlock()
+	if ok {
+		return counter
+	}
+	counterRWLock.Lock()
+	defer counterRWLock.Unlock()
+	if counter, ok = counters[name]; !ok {
+		counter = new(int64)
+		counters[name] = counter
+	}
+	return counter
+}
+
+// 累加计数器, 计数器不存在时自动创建
+func Incr(name string, delta int64) int64 {
+	return atomic.AddInt64(getCounter(name), delta)
+}
+
+func Get(name string) int64 {
+	counterRWLock.RLock()
+	defer counterRWLock.RUnlock()
+	if counter, ok := counters[name]; ok {
+		return atomic.LoadInt64(counter)
+	}
+	return 0
+}
+
+func RegisterInfo(fn InfoFunc) {
+	infoRWLock.Lock()
+	infoFuncs = append(infoFuncs, fn)
+	infoRWLock.Unlock()
+}
+
+// 所有计数器及实时统计值
+func Snapshot() map[string]int64 {
+	result := make(map[string]int64)
+	counterRWLock.RLock()
+	for name, counter := range counters {
+		result[name] = atomic.LoadInt64(counter)
+	}
+	counterRWLock.RUnlock()
+	infoRWLock.RLock()
+	defer infoRWLock.RUnlock()
+	for _, fn := range infoFuncs {
+		for name, value := range fn() {
+			result[name] = value
+		}
+	}
+	return result
+}
@@ -0,0 +1,32 @@
+package stat
+
+import (
+	"sync"
+	"testing"
+
+	"ncache/utils"
+)
+
+func TestIncr(t *testing.T) {
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Incr("test_incr", 2)
+		}()
+	}
+	wg.Wait()
+	utils.AssertMust(Get("test_incr") == 200)
+	utils.AssertMust(Get("test_not_exists") == 0)
+}
+
+func TestSnapshot(t *testing.T) {
+	Incr("test_snapshot", 1)
+	RegisterInfo(func() map[string]int64 {
+		return map[string]int64{"test_info": 10}
+	})
+	snapshot := Snapshot()
+	utils.AssertMust(snapshot["test_snapshot"] == 1)
+	utils.AssertMust(snapshot["test_info"] == 10)
+}
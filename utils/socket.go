@@ -9,7 +9,20 @@ func GetLocalAddr(sock net.Conn) string {
 	return addr.String()
 }
 
+// unix socket 的客户端可能没有地址
 func RemoteAddr(sock net.Conn) string {
 	addr := sock.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
 	return addr.String()
 }
+
+// 不含端口的远端地址, 如 unix socket 等无法解析时返回完整地址
+func RemoteIp(sock net.Conn) string {
+	addr := RemoteAddr(sock)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}